@@ -2,6 +2,7 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/code"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
@@ -9,19 +10,45 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// ErrOffsetOutOfRange is returned when reading an offset without a record.
+// It carries the range of offsets in the log when the read failed,
+// which is also attached to its status as an ErrorInfo's metadata.
 type ErrOffsetOutOfRange struct {
 	Offset uint64
+	// Lowest and Highest are the log's lowest and highest offsets. Both are 0 when the log is empty.
+	Lowest  uint64
+	Highest uint64
 }
 
+// ErrorInfo reason and metadata keys of ErrOffsetOutOfRange's status details.
+const (
+	ReasonOffsetOutOfRange = "OFFSET_OUT_OF_RANGE"
+	MetadataOffset         = "offset"
+	MetadataLowest         = "lowest"
+	MetadataHighest        = "highest"
+)
+
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
-	st := status.New(codes.Code(code.Code_OUT_OF_RANGE), fmt.Sprintf("offset out of range: %d", e.Offset))
+	st := status.New(
+		codes.Code(code.Code_OUT_OF_RANGE),
+		fmt.Sprintf("offset out of range: %d, the log's range is [%d, %d]", e.Offset, e.Lowest, e.Highest),
+	)
 	msg := fmt.Sprintf("The requested offset is outside the log's range: %d", e.Offset)
 	// errdetails allows for attaching of additional metadata to the status.
 	d := &errdetails.LocalizedMessage{
 		Locale:  "en-US",
 		Message: msg,
 	}
-	stWithDetails, err := st.WithDetails(d)
+	info := &errdetails.ErrorInfo{
+		Reason: ReasonOffsetOutOfRange,
+		Domain: "log.v1",
+		Metadata: map[string]string{
+			MetadataOffset:  strconv.FormatUint(e.Offset, 10),
+			MetadataLowest:  strconv.FormatUint(e.Lowest, 10),
+			MetadataHighest: strconv.FormatUint(e.Highest, 10),
+		},
+	}
+	stWithDetails, err := st.WithDetails(d, info)
 	if err != nil {
 		return st
 	}
@@ -31,3 +58,21 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrOffsetConflict is returned by a conditional append when the log's next offset
+// is not the offset the caller expected.
+type ErrOffsetConflict struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrOffsetConflict) GRPCStatus() *status.Status {
+	return status.New(
+		codes.Aborted,
+		fmt.Sprintf("offset conflict: expected next offset %d, got %d", e.Expected, e.Actual),
+	)
+}
+
+func (e ErrOffsetConflict) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,212 @@
+// Package client is a client of the Log service that rides out transient failures,
+// such as the server restarting, by retrying its calls.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+const (
+	// defaultMaxRetries is the number of times a failed call is retried, unless set with WithRetries.
+	defaultMaxRetries = 10
+	// defaultRetryBackoff is how long the client waits before retrying a failed call, unless set with WithRetries.
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+// Client produces records to, and consumes records from, a Log server.
+// Calls that fail with codes.Unavailable, e.g. because the server is restarting, are retried,
+// while the underlying connection reconnects to the server. It is safe for concurrent use.
+type Client struct {
+	cc           *grpc.ClientConn
+	log          api.LogClient
+	maxRetries   int
+	retryBackoff time.Duration
+	dialOpts     []grpc.DialOption
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithRetries sets the number of times a failed call is retried, and how long the client waits before each retry.
+// It defaults to 10 retries, 100ms apart.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+		c.retryBackoff = backoff
+	}
+}
+
+// WithDialOptions adds options to the dial of the connection to the server.
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(c *Client) {
+		c.dialOpts = append(c.dialOpts, opts...)
+	}
+}
+
+// NewClient returns a client of the server at addr, connecting with tlsCfg, e.g. as set up by config.SetupTLSConfig.
+// The connection is established in the background, so NewClient succeeds even if the server is down.
+func NewClient(addr string, tlsCfg *tls.Config, opts ...Option) (*Client, error) {
+	c := &Client{
+		maxRetries:   defaultMaxRetries,
+		retryBackoff: defaultRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)),
+		// reconnecting as often as calls are retried, rather than backing off up to grpc's default of 2 minutes,
+		// lets the retries reach a server that comes back.
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  c.retryBackoff,
+				Multiplier: backoff.DefaultConfig.Multiplier,
+				Jitter:     backoff.DefaultConfig.Jitter,
+				MaxDelay:   c.retryBackoff,
+			},
+		}),
+	}
+	cc, err := grpc.Dial(addr, append(dialOpts, c.dialOpts...)...)
+	if err != nil {
+		return nil, err
+	}
+	c.cc = cc
+	c.log = api.NewLogClient(cc)
+	return c, nil
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.cc.Close()
+}
+
+// Produce appends the record to the server's log and returns its offset.
+// Retries carry the same dedup key, so that a server with deduplication enabled appends the record once,
+// even if the response to an earlier attempt was lost.
+func (c *Client) Produce(ctx context.Context, record *api.Record) (uint64, error) {
+	req := &api.ProduceRequest{Record: record, DedupKey: newDedupKey()}
+	var off uint64
+	err := c.retry(ctx, func() error {
+		resp, err := c.log.Produce(ctx, req)
+		if err != nil {
+			return err
+		}
+		off = resp.Offset
+		return nil
+	})
+	return off, err
+}
+
+// Consume reads the record at off from the server's log.
+func (c *Client) Consume(ctx context.Context, off uint64) (*api.Record, error) {
+	var record *api.Record
+	err := c.retry(ctx, func() error {
+		resp, err := c.log.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		if err != nil {
+			return err
+		}
+		record = resp.Record
+		return nil
+	})
+	return record, err
+}
+
+// ConsumeAll streams the records of the server's log from offset from onwards, including records produced later on.
+// When the stream breaks on a transient failure, it is reopened after the last record received.
+// The channel is closed once ctx is done, or the stream fails for good.
+func (c *Client) ConsumeAll(ctx context.Context, from uint64) <-chan *api.Record {
+	records := make(chan *api.Record)
+	go func() {
+		defer close(records)
+		next := from
+		// the retries are counted from the last record received, so that a long-lived stream
+		// rides out any number of failures, as long as it makes progress in between.
+		for attempt := 0; ; attempt++ {
+			received, err := c.stream(ctx, next, records)
+			if received > next {
+				next, attempt = received, 0
+			}
+			if status.Code(err) != codes.Unavailable || attempt == c.maxRetries || c.wait(ctx) != nil {
+				return
+			}
+		}
+	}()
+	return records
+}
+
+// stream sends the records streamed from off onwards to records, until the stream fails.
+// It returns the offset after the last record sent, or off if none was sent.
+func (c *Client) stream(ctx context.Context, off uint64, records chan<- *api.Record) (uint64, error) {
+	stream, err := c.log.ConsumeStream(ctx, &api.ConsumeRequest{Offset: off})
+	if err != nil {
+		return off, err
+	}
+	for {
+		resp, err := stream.Recv()
+		// the server only ends a stream when it shuts down, e.g. to restart.
+		if err == io.EOF {
+			return off, status.Error(codes.Unavailable, "server ended the stream")
+		}
+		if err != nil {
+			return off, err
+		}
+		if resp.Heartbeat {
+			continue
+		}
+		select {
+		case records <- resp.Record:
+			off = resp.Record.Offset + 1
+		case <-ctx.Done():
+			return off, ctx.Err()
+		}
+	}
+}
+
+// retry calls fn until it succeeds, fails with an error other than codes.Unavailable,
+// or has been retried maxRetries times, and returns fn's last error.
+// It gives up with ctx's error if ctx is done while waiting to retry.
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if status.Code(err) != codes.Unavailable || attempt == c.maxRetries {
+			return err
+		}
+		if err := c.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits for the retry backoff to pass, unless ctx is done first, in which case it returns ctx's error.
+func (c *Client) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.retryBackoff):
+		return nil
+	}
+}
+
+// newDedupKey returns a random 16 byte key, hex encoded.
+// It returns "" if no random key can be generated, which produces without deduplication,
+// rather than with a key that other produces may share.
+func newDedupKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	api "github.com/jxofficial/proglog/api/v1"
+	"github.com/jxofficial/proglog/internal/config"
+	"github.com/jxofficial/proglog/internal/log"
+	"github.com/jxofficial/proglog/internal/server"
+)
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	srv, err := startServer(listener, clog)
+	require.NoError(t, err)
+
+	tlsCfg, err := config.SetupTLSConfig(config.TLSConfig{
+		CAFile:   config.CAFile,
+		CertFile: config.ClientCertFile,
+		KeyFile:  config.ClientKeyFile,
+	})
+	require.NoError(t, err)
+	c, err := NewClient(addr, tlsCfg, WithRetries(50, 50*time.Millisecond))
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	off, err := c.Produce(ctx, &api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := c.Consume(ctx, off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	records := c.ConsumeAll(ctx, off)
+	record = <-records
+	require.Equal(t, off, record.Offset)
+
+	// the produce is retried until the server is back.
+	srv.Stop()
+	// the restarted server, or the error restarting it, is handed back to the test's goroutine.
+	restarted := make(chan *grpc.Server, 1)
+	restartErr := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			restartErr <- err
+			return
+		}
+		srv, err := startServer(listener, clog)
+		if err != nil {
+			restartErr <- err
+			return
+		}
+		restarted <- srv
+	}()
+	next, err := c.Produce(ctx, &api.Record{Value: []byte("after restart")})
+	select {
+	case srv = <-restarted:
+	case err := <-restartErr:
+		require.NoError(t, err)
+	}
+	defer srv.Stop()
+	require.NoError(t, err)
+	require.Equal(t, off+1, next)
+
+	// the stream is reopened after the last record it received.
+	record = <-records
+	require.NotNil(t, record)
+	require.Equal(t, next, record.Offset)
+	require.Equal(t, []byte("after restart"), record.Value)
+}
+
+// startServer serves the commit log on listener.
+// It doesn't take the test's *testing.T, as it is also called from other goroutines than the test's.
+func startServer(listener net.Listener, clog *log.Log) (*grpc.Server, error) {
+	tlsCfg, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: listener.Addr().String(),
+		IsServer:      true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog}, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	if err != nil {
+		return nil, err
+	}
+	go srv.Serve(listener)
+	return srv.Server, nil
+}
@@ -3,7 +3,10 @@ module github.com/jxofficial/proglog
 go 1.17
 
 require (
+	github.com/casbin/casbin v1.9.1
 	github.com/golang/protobuf v1.4.3
+	github.com/golang/snappy v0.0.4
+	github.com/soheilhy/cmux v0.1.4
 	github.com/stretchr/testify v1.7.0
 	github.com/tysonmote/gommap v0.0.1
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
@@ -13,7 +16,6 @@ require (
 
 require (
 	github.com/Knetic/govaluate v3.0.1-0.20171022003610-9aa49832a739+incompatible // indirect
-	github.com/casbin/casbin v1.9.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/net v0.0.0-20200822124328-c89045814202 // indirect
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewReloadingCertificate loads the key pair in certFile and keyFile,
+// and returns a function suitable for tls.Config.GetCertificate that serves the key pair,
+// reloading it whenever either file has changed since it was last loaded.
+// If a reload fails, e.g. because a file is malformed or only half written,
+// the previously loaded key pair keeps being served, and the failure is logged.
+func NewReloadingCertificate(certFile, keyFile string) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	r := &reloadingCertificate{certFile: certFile, keyFile: keyFile}
+	if err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r.getCertificate, nil
+}
+
+// reloadingCertificate is a key pair that is reloaded when its files change.
+// The files are checked for changes on every handshake, which only costs a stat of each file.
+type reloadingCertificate struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// certStat and keyStat identify the versions of the files cert was loaded from.
+	certStat, keyStat fileStat
+}
+
+// fileStat is the part of a file's info that changes when the file is rewritten.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(name string) (fileStat, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+func (r *reloadingCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reloadIfChanged(); err != nil {
+		log.Printf("config: keeping the previous certificate, as reloading %s failed: %v", r.certFile, err)
+	}
+	return r.cert, nil
+}
+
+// reloadIfChanged reloads the key pair if either of its files changed since it was last loaded.
+// The caller must hold r.mu, unless r is not shared yet.
+func (r *reloadingCertificate) reloadIfChanged() error {
+	certStat, err := statFile(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := statFile(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if certStat == r.certStat && keyStat == r.keyStat {
+		return nil
+	}
+	// the files are recorded as loaded even if loading fails, so that a bad pair is not reloaded on every handshake.
+	r.certStat, r.keyStat = certStat, keyStat
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	return nil
+}
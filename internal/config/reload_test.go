@@ -0,0 +1,55 @@
+package config
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadingCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reloading-certificate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	// install copies the key pair's files in place of the served ones, as a rotation would.
+	modTime := time.Now()
+	install := func(srcCertFile, srcKeyFile string) {
+		t.Helper()
+		for src, dst := range map[string]string{srcCertFile: certFile, srcKeyFile: keyFile} {
+			b, err := ioutil.ReadFile(src)
+			require.NoError(t, err)
+			require.NoError(t, ioutil.WriteFile(dst, b, 0600))
+			// the files change within the resolution of the file system's clock.
+			require.NoError(t, os.Chtimes(dst, modTime, modTime))
+		}
+		modTime = modTime.Add(time.Second)
+	}
+	requireServed := func(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), certFile, keyFile string) {
+		t.Helper()
+		want, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+		got, err := getCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		require.Equal(t, want.Certificate, got.Certificate)
+	}
+
+	install(ServerCertFile, ServerKeyFile)
+	getCertificate, err := NewReloadingCertificate(certFile, keyFile)
+	require.NoError(t, err)
+	requireServed(getCertificate, ServerCertFile, ServerKeyFile)
+
+	install(ClientCertFile, ClientKeyFile)
+	requireServed(getCertificate, ClientCertFile, ClientKeyFile)
+
+	// a malformed certificate is not served.
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("not a certificate"), 0600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	requireServed(getCertificate, ClientCertFile, ClientKeyFile)
+}
@@ -14,13 +14,34 @@ type TLSConfig struct {
 	ServerAddress string
 	IsServer      bool
 	Certificates  []tls.Certificate
+	// ReloadCertificate makes a server reload its certificate from CertFile and KeyFile when they change,
+	// so that the certificate can be rotated without restarting the server.
+	ReloadCertificate bool
+	// CAFiles are additional CA files, e.g. of intermediate CAs, whose certificates are trusted along with CAFile's.
+	CAFiles []string
+	// MinVersion is the minimum TLS version accepted, e.g. tls.VersionTLS13.
+	// It must be at least tls.VersionTLS12. Zero leaves it to crypto/tls's default.
+	MinVersion uint16
+	// CipherSuites restricts the cipher suites used up to TLS 1.2. Nil leaves them to crypto/tls's default.
+	CipherSuites []uint16
 }
 
 func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 	var err error
-	tlsConfig := &tls.Config{}
+	if cfg.MinVersion != 0 && cfg.MinVersion < tls.VersionTLS12 {
+		return nil, fmt.Errorf("minimum TLS version %#x is below TLS 1.2", cfg.MinVersion)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   cfg.MinVersion,
+		CipherSuites: cfg.CipherSuites,
+	}
 
-	if cfg.CertFile != "" && cfg.KeyFile != "" {
+	if cfg.CertFile != "" && cfg.KeyFile != "" && cfg.IsServer && cfg.ReloadCertificate {
+		tlsConfig.GetCertificate, err = NewReloadingCertificate(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if cfg.CertFile != "" && cfg.KeyFile != "" {
 		tlsConfig.Certificates = make([]tls.Certificate, 1)
 		tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 		if err != nil {
@@ -28,20 +49,26 @@ func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
 		}
 	}
 
+	caFiles := cfg.CAFiles
 	if cfg.CAFile != "" {
-		b, err := ioutil.ReadFile(cfg.CAFile)
-		if err != nil {
-			return nil, err
-		}
-		// add CA's cert to CA
+		caFiles = append([]string{cfg.CAFile}, caFiles...)
+	}
+	if len(caFiles) > 0 {
+		// add every CA's cert to the same pool
 		ca := x509.NewCertPool()
-		ok := ca.AppendCertsFromPEM(b)
-		if !ok {
-			// %q doesnt parse the \ escape char
-			return nil, fmt.Errorf(
-				"failed to parse CA root certificate: %q",
-				cfg.CAFile,
-			)
+		for _, caFile := range caFiles {
+			b, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			ok := ca.AppendCertsFromPEM(b)
+			if !ok {
+				// %q doesnt parse the \ escape char
+				return nil, fmt.Errorf(
+					"failed to parse CA root certificate: %q",
+					caFile,
+				)
+			}
 		}
 		if cfg.IsServer {
 			tlsConfig.ClientCAs = ca
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfigCAFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-ca-files-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a second CA, which signs the client's certificate.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "second CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caFile := filepath.Join(dir, "second-ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client of the second CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caTemplate, &clientKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	serverTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: ServerCertFile,
+		KeyFile:  ServerKeyFile,
+		CAFile:   CAFile,
+		CAFiles:  []string{caFile},
+		IsServer: true,
+	})
+	require.NoError(t, err)
+	clientTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CAFile:        CAFile,
+		ServerAddress: "localhost",
+	})
+	require.NoError(t, err)
+	clientTLSConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{clientDER},
+		PrivateKey:  clientKey,
+	}}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	serverErr := make(chan error)
+	go func() {
+		serverErr <- tls.Server(serverConn, serverTLSConfig).Handshake()
+	}()
+	require.NoError(t, tls.Client(clientConn, clientTLSConfig).Handshake())
+	require.NoError(t, <-serverErr)
+
+	// a CA file that fails to parse is named in the error.
+	badFile := filepath.Join(dir, "bad-ca.pem")
+	require.NoError(t, ioutil.WriteFile(badFile, []byte("not a certificate"), 0600))
+	_, err = SetupTLSConfig(TLSConfig{CAFiles: []string{caFile, badFile}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), badFile)
+}
+
+func TestSetupTLSConfigMinVersion(t *testing.T) {
+	_, err := SetupTLSConfig(TLSConfig{MinVersion: tls.VersionTLS11})
+	require.Error(t, err)
+
+	serverTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile:   ServerCertFile,
+		KeyFile:    ServerKeyFile,
+		IsServer:   true,
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), serverTLSConfig.MinVersion)
+	require.Len(t, serverTLSConfig.CipherSuites, 2)
+
+	clientTLSConfig, err := SetupTLSConfig(TLSConfig{
+		CAFile:        CAFile,
+		ServerAddress: "localhost",
+	})
+	require.NoError(t, err)
+	clientTLSConfig.MinVersion = tls.VersionTLS10
+	clientTLSConfig.MaxVersion = tls.VersionTLS11
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	serverErr := make(chan error)
+	go func() {
+		err := tls.Server(serverConn, serverTLSConfig).Handshake()
+		// unblock the client, which may be waiting on the server's reply.
+		serverConn.Close()
+		serverErr <- err
+	}()
+	require.Error(t, tls.Client(clientConn, clientTLSConfig).Handshake())
+	require.Error(t, <-serverErr)
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+// readCache is a bounded LRU of recently read records, keyed by offset,
+// which serves repeated reads of the same offsets without reading the segments' files.
+// A nil readCache caches nothing.
+type readCache struct {
+	// mu is held for every access, as reads hold the log's lock for reading only.
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	records map[uint64]*list.Element
+}
+
+type readCacheEntry struct {
+	off    uint64
+	record *api.Record
+}
+
+func newReadCache(size int) *readCache {
+	return &readCache{
+		size:    size,
+		order:   list.New(),
+		records: make(map[uint64]*list.Element, size),
+	}
+}
+
+// get returns a copy of the record cached for off, if there is one.
+// Callers get a copy, so that modifying it doesn't modify the cached record.
+func (c *readCache) get(off uint64) (*api.Record, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.records[off]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return proto.Clone(e.Value.(*readCacheEntry).record).(*api.Record), true
+}
+
+// put caches a copy of r, the record at off, evicting the least recently read record if the cache is full.
+func (c *readCache) put(off uint64, r *api.Record) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.records[off]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.records[off] = c.order.PushFront(&readCacheEntry{off: off, record: proto.Clone(r).(*api.Record)})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.records, oldest.Value.(*readCacheEntry).off)
+	}
+}
+
+// removeRange drops the records with offsets in [from, to), e.g. because their segment was removed.
+func (c *readCache) removeRange(from, to uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for off, e := range c.records {
+		if from <= off && off < to {
+			c.order.Remove(e)
+			delete(c.records, off)
+		}
+	}
+}
+
+// clear drops every record.
+func (c *readCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.records = make(map[uint64]*list.Element, c.size)
+}
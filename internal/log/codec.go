@@ -0,0 +1,122 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// Codec identifies how a record's data is encoded in the store.
+type Codec uint8
+
+const (
+	// CodecNone stores the record data as is.
+	CodecNone Codec = iota
+	// CodecGzip compresses the record data with gzip.
+	CodecGzip
+	// CodecSnappy compresses the record data with Snappy,
+	// which compresses less than gzip but takes far less CPU to compress and decompress.
+	CodecSnappy
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecSnappy:
+		return "snappy"
+	default:
+		return "unknown"
+	}
+}
+
+// valid returns whether c is a known codec.
+func (c Codec) valid() bool {
+	return c <= CodecSnappy
+}
+
+// encode returns p encoded with the codec.
+func (c Codec) encode(p []byte) ([]byte, error) {
+	switch c {
+	case CodecGzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), nil
+	default:
+		return p, nil
+	}
+}
+
+// errDecodedTooLarge is returned by decode when the data decodes to more than the given maximum.
+var errDecodedTooLarge = errors.New("decoded data is too large")
+
+// decode returns p decoded with the codec.
+// It returns errDecodedTooLarge rather than decoding more than max bytes, if max is nonzero,
+// as a small corrupt or malicious record can otherwise decode to an arbitrarily large allocation.
+func (c Codec) decode(p []byte, max uint64) ([]byte, error) {
+	switch c {
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if max == 0 {
+			return ioutil.ReadAll(r)
+		}
+		decoded, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(decoded)) > max {
+			return nil, errDecodedTooLarge
+		}
+		return decoded, nil
+	case CodecSnappy:
+		// the decoded length is read from the data's header, before allocating it.
+		n, err := snappy.DecodedLen(p)
+		if err != nil {
+			return nil, err
+		}
+		if max > 0 && uint64(n) > max {
+			return nil, errDecodedTooLarge
+		}
+		return snappy.Decode(nil, p)
+	default:
+		return p, nil
+	}
+}
+
+// ReadInfo describes how a record is laid out in the store.
+type ReadInfo struct {
+	// CompressedBytes is the size of the record data as it is stored on disk,
+	// excluding the codec byte, the length prefix and the checksum.
+	CompressedBytes uint64
+	// UncompressedBytes is the size of the record data after decoding,
+	// i.e. the size of the marshalled record.
+	UncompressedBytes uint64
+	Codec             Codec
+}
+
+// AppendInfo describes where an appended record is stored.
+type AppendInfo struct {
+	Offset uint64
+	// Position is the byte position of the record in its segment's store.
+	Position uint64
+	// BaseOffset is the base offset of the segment the record was appended to.
+	BaseOffset uint64
+}
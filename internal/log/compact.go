@@ -0,0 +1,132 @@
+package log
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+// compactDir is the directory, within the log's directory, that Compact writes compacted segments to
+// before moving them in place of the original segments.
+const compactDir = ".compact"
+
+// Compact removes the records that aren't the latest record with their key from the log's sealed segments,
+// i.e. it retains only the latest value of each key, like Kafka's log compaction.
+// Records without a key are always retained.
+// The active segment is never compacted, but its records count towards the latest record of each key.
+//
+// Retained records keep their offsets, so existing consumers' offsets stay valid,
+// and reading an offset whose record was compacted away returns api.ErrOffsetOutOfRange.
+// Sealed segments left without records are removed.
+func (l *Log) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+
+	latest := make(map[string]uint64)
+	for _, s := range l.segments {
+		err := s.forEach(func(r *api.Record) error {
+			if len(r.Key) > 0 {
+				latest[string(r.Key)] = r.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	keep := func(r *api.Record) bool {
+		return len(r.Key) == 0 || latest[string(r.Key)] == r.Offset
+	}
+
+	dir := path.Join(l.Dir, compactDir)
+	if err := os.MkdirAll(dir, l.dirMode()); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// the segments are replaced one by one, so that the log stays usable if compacting a segment fails.
+	for i, s := range l.segments {
+		if s == l.activeSegment {
+			continue
+		}
+		compacted, err := l.compactSegment(s, dir, keep)
+		if err != nil {
+			return err
+		}
+		if compacted != s {
+			l.forgetSegment(s)
+		}
+		l.segments[i] = compacted
+	}
+	var segments []*segment
+	for _, s := range l.segments {
+		if s != nil {
+			segments = append(segments, s)
+		}
+	}
+	l.segments = segments
+	l.Metrics.SetSegments(len(l.segments))
+	return nil
+}
+
+// compactSegment writes the records of s that should be kept to a new segment in dir,
+// and moves the new segment's files in place of s's.
+// It returns the segment opened from the moved files, s itself if all its records are kept,
+// or nil if none are, in which case s is removed.
+// The caller must hold l.mu.
+func (l *Log) compactSegment(s *segment, dir string, keep func(*api.Record) bool) (*segment, error) {
+	compacted, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	var dropped bool
+	err = s.forEach(func(r *api.Record) error {
+		if !keep(r) {
+			dropped = true
+			return nil
+		}
+		return compacted.appendAt(r)
+	})
+	if err != nil {
+		compacted.Remove()
+		return nil, err
+	}
+	if !dropped {
+		return s, compacted.Remove()
+	}
+	if compacted.nextOffset == compacted.baseOffset {
+		if err := compacted.Remove(); err != nil {
+			return nil, err
+		}
+		return nil, s.Remove()
+	}
+
+	if err := compacted.Close(); err != nil {
+		return nil, err
+	}
+	if err := s.Close(); err != nil {
+		return nil, err
+	}
+	// the files can't be moved all at once, so s's indexes are removed before the compacted files are moved,
+	// and a crash in between leaves a store without indexes rather than a store with the indexes of the other one.
+	// Whichever store that is, its indexes are rebuilt from its records when the log is opened.
+	for _, name := range []string{s.index.Name(), s.timeIndex.Name()} {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range []string{compacted.store.Name(), compacted.index.Name(), compacted.timeIndex.Name()} {
+		if err := os.Rename(name, path.Join(l.Dir, filepath.Base(name))); err != nil {
+			return nil, err
+		}
+	}
+	return l.openSegment(s.baseOffset)
+}
@@ -1,9 +1,161 @@
 package log
 
+import (
+	"os"
+	"time"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+// FormatVersion is the newest version of the on-disk format of the store and index files.
+// Stores are read regardless of the version they were framed with, up to this one.
+const FormatVersion = 1
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
-		InitialOffset uint64
+		// IndexGrowIncrement makes an index file start small and grow by this many bytes whenever it fills up,
+		// up to MaxIndexBytes, instead of taking up MaxIndexBytes from the start.
+		// Zero preallocates MaxIndexBytes.
+		IndexGrowIncrement uint64
+		InitialOffset      uint64
+		// MaxAge is how long a segment is appended to before the log rolls to a new segment,
+		// even if the segment isn't maxed. Zero means segments are only rolled by size.
+		MaxAge time.Duration
+		// MaxRecordBytes bounds the size of a marshalled record. Appending a larger record fails with ErrRecordTooLarge.
+		// Zero means unbounded.
+		MaxRecordBytes uint64
+	}
+	Store struct {
+		// ChecksumEnabled makes the store follow each record with a CRC-32 checksum of its data,
+		// which is verified when the record is read.
+		// It must be set the same way every time the log is opened,
+		// stores written without checksums can only be read with checksums disabled.
+		ChecksumEnabled bool
+		// Compression is the codec records are compressed with when appended.
+		// Records that don't get smaller when compressed are stored uncompressed.
+		// The codec is recorded with each record, so a store can be read regardless of this setting.
+		// Stores framed with version 0 can't record the codec, so their records are stored uncompressed,
+		// and stores created while it is set are framed with version 1 at least.
+		Compression Codec
+		// FormatVersion is the version new store files are framed with, at most the package's FormatVersion.
+		// Version 0, the default, frames a record as the length of its data followed by the data.
+		// Version 1 starts the file with a header holding the version,
+		// and precedes every record with a byte holding the codec its data is compressed with.
+		// A store keeps the version it was created with, which is recorded in its file,
+		// so a store can be read and appended to regardless of this setting.
+		FormatVersion uint8
+		// WriteBufferSize is the size of the buffer appended records are written to before the store's file.
+		// Larger buffers reduce the number of writes to the file for large records.
+		// Zero uses bufio's default size.
+		WriteBufferSize int
+		// MmapReads serves reads from a read-only memory map of the store's file instead of reading the file,
+		// which is faster for frequent random reads. The map is extended as the store grows,
+		// and the bytes past it, e.g. records appended since, are read from the file.
+		MmapReads bool
+		// SyncPolicy is when appended records are committed to persistent storage,
+		// rather than only when the store is read from, sealed, synced or closed.
+		SyncPolicy SyncPolicy
+		// SyncInterval is how often records are committed to persistent storage under the SyncInterval policy.
+		// It defaults to one second.
+		SyncInterval time.Duration
+		// MaxRecordBytes bounds the length of the record data read from the store, as stored, i.e. compressed.
+		// Reading a record whose length prefix exceeds it fails with ErrCorruptRecord,
+		// rather than allocating however many bytes a corrupt length asks for.
+		// Zero only bounds the length by the size of the store.
+		// Compressed record data is decompressed to at most Segment.MaxRecordBytes if set, or else to at most MaxRecordBytes,
+		// and reading a record that decompresses to more fails with ErrCorruptRecord.
+		MaxRecordBytes uint64
+	}
+	Log struct {
+		// MaxSegments bounds the number of segments in the log.
+		// When rolling to a new segment exceeds it, the oldest segments are removed,
+		// along with their records. Zero means unbounded.
+		MaxSegments int
+	}
+	// SyncOnRollover syncs a segment's files to disk when it is sealed because the log rolled to a new segment.
+	// It defaults to true when nil.
+	SyncOnRollover *bool
+	// ReadRepair enables repairing a bad index entry of a sealed segment when a read through it fails,
+	// by finding the record's position in the store instead.
+	ReadRepair bool
+	// ReadCacheSize is the number of most recently read records Read keeps in memory,
+	// so that reading them again doesn't read the segments' files, e.g. for consumers re-reading the same offsets.
+	// Zero disables the cache.
+	ReadCacheSize int
+	// ReadOnly opens the log's files for reading only, e.g. for backup tooling running alongside the log's writer.
+	// Appending to, truncating, compacting or removing the log returns ErrReadOnly,
+	// partially written records are left in place rather than truncated, and ReadRepair is ignored.
+	// The log must have at least one segment.
+	ReadOnly bool
+	// MaxVerifyConcurrency bounds the number of segments Verify and DiskUsageByTime scan at once.
+	// It defaults to GOMAXPROCS. Stats doesn't scan segments, as it sums sizes the log keeps in memory,
+	// so it is left sequential, which also keeps its stats from a single point in time.
+	MaxVerifyConcurrency int
+	// FileMode is the permissions the log's files are created with, e.g. 0600 to keep them private to their owner.
+	// The directories the log creates get the same permissions, plus execute wherever read is granted.
+	// The process's umask applies on top. It defaults to 0644, and must let the owner read and write.
+	FileMode os.FileMode
+	// Clock returns the current time. It defaults to time.Now.
+	// It isn't saved with a topic's config, and neither are Logger, Metrics and OnAppend, see LogManager.
+	Clock func() time.Time `json:"-"`
+	// Logger reports notable events, such as recovery actions taken when opening segments.
+	// It defaults to the standard library's logger.
+	Logger Logger `json:"-"`
+	// Metrics records the log's appends, reads and segments. It defaults to recording nothing.
+	Metrics LogMetrics `json:"-"`
+	// OnAppend is called with each record appended to the log and its offset, e.g. to maintain a materialized view.
+	// It is called in append order, once the record is appended, after the log's lock is released,
+	// so that reads don't wait on it. The next append returns once OnAppend has returned for the previous one.
+	// It isn't called for records that fail to append, and must not append to the log itself.
+	OnAppend func(offset uint64, r *api.Record) `json:"-"`
+}
+
+// SyncPolicy is when a store commits appended records to persistent storage.
+type SyncPolicy uint8
+
+const (
+	// SyncNone leaves records in the store's buffer until it is read from, sealed, synced or closed.
+	SyncNone SyncPolicy = iota
+	// SyncAlways commits every record to persistent storage before Append returns.
+	SyncAlways
+	// SyncInterval commits records to persistent storage in the background, every Config.Store.SyncInterval.
+	SyncInterval
+)
+
+// Logger is the subset of the standard library's *log.Logger used by the log.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// defaultFileMode is the FileMode used when Config.FileMode is zero.
+const defaultFileMode os.FileMode = 0644
+
+// fileMode returns the permissions the log's files are created with.
+func (c Config) fileMode() os.FileMode {
+	if c.FileMode == 0 {
+		return defaultFileMode
+	}
+	return c.FileMode
+}
+
+// dirMode returns the permissions the log's directories are created with,
+// which are the file mode with execute added wherever read is granted, so that the directories can be traversed.
+func (c Config) dirMode() os.FileMode {
+	m := c.fileMode()
+	return m | (m&0444)>>2
+}
+
+// syncOnRollover returns whether sealed segments are synced when the log rolls.
+func (c Config) syncOnRollover() bool {
+	return c.SyncOnRollover == nil || *c.SyncOnRollover
+}
+
+// now returns the current time according to the config's clock.
+func (c Config) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
 	}
+	return time.Now()
 }
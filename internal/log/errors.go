@@ -0,0 +1,114 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrEmptyLog is returned when reading the latest record of a log without records.
+var ErrEmptyLog = errors.New("log is empty")
+
+// ErrLogNotFound is returned when opening a log in a directory without segments with OpenLog.
+var ErrLogNotFound = errors.New("log not found")
+
+// ErrStopIteration is returned by the function passed to Log.Iterate to stop iterating early.
+// Iterate then returns nil rather than the error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// ErrIndexFull is returned when appending to a segment whose index has no room for another entry.
+// The log rolls to a new segment and appends there instead.
+var ErrIndexFull = errors.New("index is full")
+
+// ErrLogClosed is returned when using a log after Close or Remove closed it.
+var ErrLogClosed = errors.New("log is closed")
+
+// ErrReadOnly is returned when modifying a log opened with Config.ReadOnly.
+var ErrReadOnly = errors.New("log is read-only")
+
+// ErrNoCommittedOffset is returned when fetching the offset of a consumer group that has not committed one.
+var ErrNoCommittedOffset = errors.New("no committed offset")
+
+// ErrIndexMismatch is returned when the record an index entry points to
+// does not have the offset the entry was looked up with.
+type ErrIndexMismatch struct {
+	Offset uint64
+	Found  uint64
+}
+
+func (e ErrIndexMismatch) Error() string {
+	return fmt.Sprintf("index entry for offset %d points to record with offset %d", e.Offset, e.Found)
+}
+
+// ErrCorruptRecord is returned when a record read from the store is corrupt,
+// e.g. when its data does not match its checksum, or its length runs past the end of the store.
+type ErrCorruptRecord struct {
+	// Pos is the position of the record in the store.
+	Pos uint64
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("corrupt record at position %d", e.Pos)
+}
+
+// ErrPositionOutOfRange is returned when reading a record at a position past the end of the store,
+// e.g. because the index entry the position comes from is corrupt.
+type ErrPositionOutOfRange struct {
+	Pos       uint64
+	StoreSize uint64
+}
+
+func (e ErrPositionOutOfRange) Error() string {
+	return fmt.Sprintf("position %d is past the end of the store of size %d", e.Pos, e.StoreSize)
+}
+
+// ErrOffsetTooLarge is returned when a relative offset does not fit in an index entry,
+// whose offset is 4 bytes wide.
+type ErrOffsetTooLarge struct {
+	Offset uint64
+}
+
+func (e ErrOffsetTooLarge) Error() string {
+	return fmt.Sprintf("relative offset %d does not fit in an index entry", e.Offset)
+}
+
+// ErrOutOfSequence is returned when a record is appended at an offset other than the log's next offset,
+// which would either leave a gap in the log or duplicate a record already in it.
+type ErrOutOfSequence struct {
+	Offset uint64
+	Next   uint64
+}
+
+func (e ErrOutOfSequence) Error() string {
+	if e.Offset < e.Next {
+		return fmt.Sprintf("offset %d is already in the log, whose next offset is %d", e.Offset, e.Next)
+	}
+	return fmt.Sprintf("offset %d would leave a gap after the log's next offset %d", e.Offset, e.Next)
+}
+
+// ErrRecordTooLarge is returned when appending a record larger than Config.Segment.MaxRecordBytes.
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return fmt.Sprintf("record of %d bytes is larger than the maximum of %d bytes", e.Size, e.Max)
+}
+
+// ErrTopicNotFound is returned when using a topic that a LogManager does not host.
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return fmt.Sprintf("topic %q not found", e.Topic)
+}
+
+// ErrTopicExists is returned when creating a topic that a LogManager already hosts.
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) Error() string {
+	return fmt.Sprintf("topic %q already exists", e.Topic)
+}
@@ -2,7 +2,10 @@ package log
 
 import (
 	"io"
+	"math"
 	"os"
+	"sort"
+	"sync"
 
 	"github.com/tysonmote/gommap"
 )
@@ -23,36 +26,148 @@ var (
 type index struct {
 	file *os.File
 	mmap gommap.MMap
+	// mu is write locked by repair, which rewrites an entry while the log is only read locked,
+	// and read locked by the reads of the entries, so that they don't see a half rewritten entry.
+	// Appends don't take it, as they hold the log's write lock, which excludes reads.
+	mu sync.RWMutex
+	// baseOffset is the offset of the segment's first record,
+	// which the relative offsets stored in the index are relative to.
+	baseOffset uint64
 	// size is directly proportional to the current max store record offset,
 	// where size = current max store record offset * indexEntryWidth
 	size uint64
+	// maxBytes is the size the index file can grow to, in whole index entries.
+	maxBytes uint64
+	// growBy is how many bytes the file grows by when the index fills the memory map,
+	// or zero if the file is given maxBytes from the start.
+	growBy uint64
+	// readOnly is whether the file is opened for reading only, in which case it is mapped as is, and never written to.
+	readOnly bool
+	// closed is whether Close has closed the file, after which Close does nothing.
+	closed bool
 }
 
-func newIndex(f *os.File, c Config) (*index, error) {
-	idx := &index{file: f}
+func newIndex(f *os.File, c Config, baseOffset uint64) (*index, error) {
+	idx := &index{
+		file:       f,
+		baseOffset: baseOffset,
+		// the bytes past the last whole index entry can never be written to.
+		maxBytes: nearestMultiple(c.Segment.MaxIndexBytes, indexEntryWidth),
+		readOnly: c.ReadOnly,
+	}
+	if inc := c.Segment.IndexGrowIncrement; inc > 0 {
+		idx.growBy = nearestMultiple(inc, indexEntryWidth)
+		if idx.growBy == 0 {
+			idx.growBy = indexEntryWidth
+		}
+	}
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
-	// expand the file size before creating the memory map
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	if idx.readOnly {
+		err = idx.mapReadOnly()
+	} else {
+		err = idx.mapFile(idx.size + idx.growBy)
+	}
+	if err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),
+	idx.size = idx.completeSize()
+	return idx, nil
+}
+
+// mapReadOnly memory maps the file as is, for reading only.
+// An empty file can't be mapped, and has no entries to read anyway.
+func (i *index) mapReadOnly() error {
+	if i.size == 0 {
+		return nil
+	}
+	m, err := gommap.Map(i.file.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	i.mmap = m
+	return nil
+}
+
+// completeSize returns the size of the index up to its first incomplete entry, if any.
+// An index that wasn't closed, e.g. after a crash, can end with a partially written entry,
+// and with the zeroed space its file was expanded with.
+// As each entry's offset is written after its position, and offsets are increasing,
+// an entry whose offset isn't greater than the previous entry's was never completed, and neither were the ones after it.
+// The first entry has no previous entry to compare with, so a zeroed first entry is only dropped by truncateAt,
+// once the segment checks it against its store.
+func (i *index) completeSize() uint64 {
+	size := nearestMultiple(i.size, indexEntryWidth)
+	if size > uint64(len(i.mmap)) {
+		size = nearestMultiple(uint64(len(i.mmap)), indexEntryWidth)
+	}
+	entries := int(size / indexEntryWidth)
+	for n := 1; n < entries; n++ {
+		if i.entryOffset(n) <= i.entryOffset(n-1) {
+			return uint64(n) * indexEntryWidth
+		}
+	}
+	return size
+}
+
+// truncateAt drops the entries from the first one that valid returns false for, along with the ones after it.
+// It is used when opening a segment, to drop the entries left by a crash that completeSize can't tell are incomplete.
+func (i *index) truncateAt(valid func(n int) bool) {
+	for n := 0; n < i.entries(); n++ {
+		if !valid(n) {
+			i.size = uint64(n) * indexEntryWidth
+			return
+		}
+	}
+}
+
+// entryPos returns the position of the n-th entry (starting from 0).
+func (i *index) entryPos(n int) uint64 {
+	posInIndexFile := uint64(n) * indexEntryWidth
+	return enc.Uint64(i.mmap[posInIndexFile+offWidth : posInIndexFile+indexEntryWidth])
+}
+
+// mapFile expands the file to n bytes, or to maxBytes when growing is disabled or n is past it,
+// and memory maps it, replacing the current memory map if any.
+func (i *index) mapFile(n uint64) error {
+	if i.growBy == 0 || n > i.maxBytes {
+		n = i.maxBytes
+	}
+	if i.mmap != nil {
+		if err := i.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		i.mmap = nil
+	}
+	// expand the file size before creating the memory map.
+	if err := i.file.Truncate(int64(n)); err != nil {
+		return err
+	}
+	m, err := gommap.Map(
+		i.file.Fd(),
 		gommap.PROT_READ|gommap.PROT_WRITE,
 		gommap.MAP_SHARED,
-	); err != nil {
-		return nil, err
+	)
+	if err != nil {
+		return err
 	}
-	return idx, nil
+	i.mmap = m
+	return nil
 }
 
 // Read takes in an offset (in) and returns the associated record's offset and position in the store.
 // Offset is the number corresponding to the record.
-// We use uint32 for out to save 4 bytes per index entry.
+// We use uint32 for out to save 4 bytes per index entry, so in must fit in a uint32,
+// otherwise ErrOffsetTooLarge is returned.
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
+	if in > math.MaxUint32 {
+		return 0, 0, ErrOffsetTooLarge{Offset: uint64(in)}
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	if i.size == 0 {
 		return 0, 0, io.EOF
 	}
@@ -71,25 +186,142 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
-// Write appends offset and pos to the index.
-func (i *index) Write(off uint32, pos uint64) error {
+// Lookup returns the position in the store of the record with the given absolute offset,
+// or io.EOF if the index has no entry for it.
+// Unlike Read, it does not assume that the index's offsets are contiguous:
+// it binary searches the entries by their offset, which only requires them to be in increasing order.
+func (i *index) Lookup(absoluteOffset uint64) (pos uint64, err error) {
+	if absoluteOffset < i.baseOffset {
+		return 0, io.EOF
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	n := i.searchLocked(absoluteOffset)
+	if n == i.entries() || i.entryOffset(n) != absoluteOffset {
+		return 0, io.EOF
+	}
+	posInIndexFile := uint64(n) * indexEntryWidth
+	return enc.Uint64(i.mmap[posInIndexFile+offWidth : posInIndexFile+indexEntryWidth]), nil
+}
+
+// search returns the number (starting from 0) of the first entry whose absolute offset is at least absoluteOffset,
+// or the number of entries if there is none.
+func (i *index) search(absoluteOffset uint64) int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.searchLocked(absoluteOffset)
+}
+
+// searchLocked is like search. The caller must hold i.mu.
+func (i *index) searchLocked(absoluteOffset uint64) int {
+	return sort.Search(i.entries(), func(n int) bool {
+		return i.entryOffset(n) >= absoluteOffset
+	})
+}
+
+// entries returns the number of entries in the index.
+func (i *index) entries() int {
+	return int(i.size / indexEntryWidth)
+}
+
+// entryOffset returns the absolute offset of the n-th entry (starting from 0).
+func (i *index) entryOffset(n int) uint64 {
+	posInIndexFile := uint64(n) * indexEntryWidth
+	return i.baseOffset + uint64(enc.Uint32(i.mmap[posInIndexFile:posInIndexFile+offWidth]))
+}
+
+// Write appends the relative offset off and pos to the index.
+// It returns ErrOffsetTooLarge if off does not fit in an index entry, and ErrIndexFull if the index has no room left.
+func (i *index) Write(off uint64, pos uint64) error {
+	if i.readOnly {
+		return ErrReadOnly
+	}
+	if off > math.MaxUint32 {
+		return ErrOffsetTooLarge{Offset: off}
+	}
 	if uint64(len(i.mmap)) < i.size+indexEntryWidth {
-		return io.EOF
+		if i.growBy == 0 || uint64(len(i.mmap)) >= i.maxBytes {
+			return ErrIndexFull
+		}
+		if err := i.mapFile(i.size + i.growBy); err != nil {
+			return err
+		}
 	}
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
+	// the offset is written last, as it marks the entry as complete, see completeSize.
 	enc.PutUint64(i.mmap[i.size+offWidth:i.size+indexEntryWidth], pos)
+	enc.PutUint32(i.mmap[i.size:i.size+offWidth], uint32(off))
 	i.size += indexEntryWidth
 	return nil
 }
 
-func (i *index) Close() error {
+// removeLast removes the last entry, e.g. when the record it points to couldn't be appended.
+// The entry is zeroed, so that no stale entry is left past the end of the index.
+func (i *index) removeLast() {
+	if i.size < indexEntryWidth {
+		return
+	}
+	i.size -= indexEntryWidth
+	copy(i.mmap[i.size:i.size+indexEntryWidth], make([]byte, indexEntryWidth))
+}
+
+// repair overwrites the position of the existing entry with the given relative offset,
+// or returns io.EOF if the index has no such entry.
+// Like Lookup, it doesn't assume that the index's offsets are contiguous, as they aren't once the segment is compacted.
+// It may be called while the index is read, see i.mu.
+func (i *index) repair(off uint64, pos uint64) error {
+	if i.readOnly {
+		return ErrReadOnly
+	}
+	if off > math.MaxUint32 {
+		return ErrOffsetTooLarge{Offset: off}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n := i.searchLocked(i.baseOffset + off)
+	if n == i.entries() || i.entryOffset(n) != i.baseOffset+off {
+		return io.EOF
+	}
+	posInIndexFile := uint64(n) * indexEntryWidth
+	enc.PutUint64(i.mmap[posInIndexFile+offWidth:posInIndexFile+indexEntryWidth], pos)
+	return nil
+}
+
+// Sync commits the index entries to persistent storage.
+func (i *index) Sync() error {
+	if i.readOnly {
+		return nil
+	}
 	// sync the mmap with the file object
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
 
 	// commit the content of the file to persistent storage
-	if err := i.file.Sync(); err != nil {
+	return i.file.Sync()
+}
+
+// Seal syncs the index and truncates the file to the index entries written,
+// so that the file's size reflects the index's size even if the index is never closed.
+// Nothing must be written to the index after it is sealed.
+func (i *index) Seal() error {
+	if err := i.Sync(); err != nil {
+		return err
+	}
+	return i.file.Truncate(int64(i.size))
+}
+
+func (i *index) Close() error {
+	if i.closed {
+		return nil
+	}
+	if i.readOnly {
+		if err := i.file.Close(); err != nil {
+			return err
+		}
+		i.closed = true
+		return nil
+	}
+	if err := i.Sync(); err != nil {
 		return err
 	}
 
@@ -98,7 +330,11 @@ func (i *index) Close() error {
 	if err := i.file.Truncate(int64(i.size)); err != nil {
 		return err
 	}
-	return i.file.Close()
+	if err := i.file.Close(); err != nil {
+		return err
+	}
+	i.closed = true
+	return nil
 }
 
 func (i *index) Name() string {
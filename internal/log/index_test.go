@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 
@@ -16,7 +17,7 @@ func TestIndex(t *testing.T) {
 
 	c := Config{}
 	c.Segment.MaxIndexBytes = 1024
-	idx, err := newIndex(f, c)
+	idx, err := newIndex(f, c, 0)
 	require.NoError(t, err)
 	require.Equal(t, f.Name(), idx.Name())
 
@@ -24,7 +25,7 @@ func TestIndex(t *testing.T) {
 	require.Error(t, err)
 
 	indexEntries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -50,9 +51,132 @@ func TestIndex(t *testing.T) {
 
 	// index should take its state from the file
 	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
-	idx, err = newIndex(f, c)
+	idx, err = newIndex(f, c, 0)
 	off, pos, err := idx.Read(-1)
 	// last index record offset and pos should be 1 and 10 respectively
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, uint64(10), pos)
 }
+
+func TestIndexLookup(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_lookup_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c, 100)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	_, err = idx.Lookup(100)
+	require.Equal(t, io.EOF, err)
+
+	// non-contiguous relative offsets, e.g. after records were compacted away.
+	entries := []struct {
+		Off uint64
+		Pos uint64
+	}{
+		{Off: 0, Pos: 0},
+		{Off: 2, Pos: 10},
+		{Off: 5, Pos: 20},
+		{Off: 9, Pos: 30},
+	}
+	for _, e := range entries {
+		require.NoError(t, idx.Write(e.Off, e.Pos))
+	}
+
+	for _, e := range entries {
+		pos, err := idx.Lookup(100 + e.Off)
+		require.NoError(t, err)
+		require.Equal(t, e.Pos, pos)
+	}
+
+	for _, off := range []uint64{0, 99, 101, 103, 108, 110} {
+		_, err = idx.Lookup(off)
+		require.Equal(t, io.EOF, err, "offset %d", off)
+	}
+}
+
+func TestIndexOffsetTooLarge(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_offset_too_large_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c, 0)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	// without the check, the offset would be truncated to 0.
+	off := uint64(math.MaxUint32) + 1
+	require.Equal(t, ErrOffsetTooLarge{Offset: off}, idx.Write(off, 0))
+	require.Equal(t, ErrOffsetTooLarge{Offset: off}, idx.repair(off, 0))
+	_, _, err = idx.Read(int64(off))
+	require.Equal(t, ErrOffsetTooLarge{Offset: off}, err)
+
+	// nothing was written.
+	_, _, err = idx.Read(-1)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestIndexGrowIncrement(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexGrowIncrement = 3 * indexEntryWidth
+	idx, err := newIndex(f, c, 0)
+	require.NoError(t, err)
+
+	for off := uint64(0); off < 4; off++ {
+		require.NoError(t, idx.Write(off, off*10))
+	}
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(6*indexEntryWidth), fi.Size())
+	for off := uint64(0); off < 4; off++ {
+		_, pos, err := idx.Read(int64(off))
+		require.NoError(t, err)
+		require.Equal(t, off*10, pos)
+	}
+
+	// the index still grows up to MaxIndexBytes.
+	off := uint64(4)
+	for ; idx.Write(off, off*10) == nil; off++ {
+	}
+	require.Equal(t, uint64(1024)/indexEntryWidth, off)
+	require.NoError(t, idx.Close())
+}
+
+func TestIndexIgnoresIncompleteEntries(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c, 0)
+	require.NoError(t, err)
+	for off := uint64(0); off < 3; off++ {
+		require.NoError(t, idx.Write(off, off*10))
+	}
+	// a crash after the position of the next entry is written, but before its offset is,
+	// leaves the index file at its expanded size.
+	enc.PutUint64(idx.mmap[idx.size+offWidth:idx.size+indexEntryWidth], 30)
+	require.NoError(t, idx.Sync())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c, 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, idx.entries())
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(20), pos)
+	require.NoError(t, idx.Close())
+}
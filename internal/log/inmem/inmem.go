@@ -0,0 +1,62 @@
+// Package inmem provides a commit log that keeps its records in memory,
+// for testing and for deployments that don't need their records to outlive the process.
+package inmem
+
+import (
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	api "github.com/jxofficial/proglog/api/v1"
+	"github.com/jxofficial/proglog/internal/log"
+)
+
+// Log is a commit log whose records are kept in memory.
+// It implements server.CommitLog.
+type Log struct {
+	mu      sync.RWMutex
+	records []*api.Record
+}
+
+// NewLog returns an empty Log.
+func NewLog() *Log {
+	return &Log{}
+}
+
+// Append appends a copy of r to the log, and returns the offset assigned to it.
+func (l *Log) Append(r *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.Offset = uint64(len(l.records))
+	l.records = append(l.records, proto.Clone(r).(*api.Record))
+	return r.Offset, nil
+}
+
+// Read returns a copy of the record at off, or api.ErrOffsetOutOfRange if there is none.
+func (l *Log) Read(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if off >= uint64(len(l.records)) {
+		err := api.ErrOffsetOutOfRange{Offset: off}
+		if len(l.records) > 0 {
+			err.Highest = uint64(len(l.records) - 1)
+		}
+		return nil, err
+	}
+	return proto.Clone(l.records[off]).(*api.Record), nil
+}
+
+// LowestOffset returns the offset of the first record, which is always 0.
+func (l *Log) LowestOffset() (uint64, error) {
+	return 0, nil
+}
+
+// HighestOffset returns the offset of the most recent record, or log.ErrEmptyLog if the log is empty.
+func (l *Log) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.records) == 0 {
+		return 0, log.ErrEmptyLog
+	}
+	return uint64(len(l.records) - 1), nil
+}
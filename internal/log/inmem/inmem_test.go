@@ -0,0 +1,45 @@
+package inmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/jxofficial/proglog/api/v1"
+	commitlog "github.com/jxofficial/proglog/internal/log"
+)
+
+func TestLog(t *testing.T) {
+	log := NewLog()
+	_, err := log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	_, err = log.HighestOffset()
+	require.Equal(t, commitlog.ErrEmptyLog, err)
+
+	for i := uint64(0); i < 3; i++ {
+		r := &api.Record{Value: []byte("hello world")}
+		off, err := log.Append(r)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, i, r.Offset)
+	}
+
+	// the log keeps its own copy of the records.
+	r, err := log.Read(1)
+	require.NoError(t, err)
+	r.Value[0] = 'H'
+	r, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), r.Value)
+	require.Equal(t, uint64(1), r.Offset)
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	_, err = log.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3, Highest: 2}, err)
+}
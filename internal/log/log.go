@@ -1,14 +1,21 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
+	stdlog "log"
+	"math"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 
 	api "github.com/jxofficial/proglog/api/v1"
 )
@@ -24,8 +31,21 @@ type Log struct {
 	mu            sync.RWMutex
 	activeSegment *segment
 	segments      []*segment
+	recoveryMu    sync.Mutex
+	recovery      RecoveryStats
+	// appended is closed (and replaced) whenever a record is appended, to wake up waiters.
+	appended chan struct{}
+	// closed is whether Close has closed the segments, after which Close does nothing.
+	closed bool
+	// pendingAppends are the records OnAppend is yet to be called with, see unlockAppend.
+	pendingAppends []appendedRecord
+	// onAppendMu is held while calling OnAppend, so that it is called for one append at a time.
+	onAppendMu sync.Mutex
+	// readCache holds the records recently read with Read when Config.ReadCacheSize is set, and is nil otherwise.
+	readCache *readCache
 }
 
+// NewLog opens the log in dir, creating dir and its first segment if dir has none.
 func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
@@ -34,39 +54,539 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	// the bytes past the last whole index entry can never be written to,
+	// so they don't count towards the index's size. The effective size is kept in the log's Config.
+	c.Segment.MaxIndexBytes = nearestMultiple(c.Segment.MaxIndexBytes, indexEntryWidth)
+	if c.Segment.MaxIndexBytes == 0 {
+		return nil, fmt.Errorf("max index bytes must fit at least one index entry of %d bytes", indexEntryWidth)
+	}
+
+	if c.FileMode&^os.ModePerm != 0 || c.FileMode != 0 && c.FileMode&0600 != 0600 {
+		return nil, fmt.Errorf("file mode %s must be a permission mode letting the owner read and write", c.FileMode)
+	}
+	if c.Store.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("format version %d is newer than the supported version %d", c.Store.FormatVersion, FormatVersion)
+	}
+
+	if c.Logger == nil {
+		c.Logger = stdlog.Default()
+	}
+	if c.Metrics == nil {
+		c.Metrics = nopLogMetrics{}
+	}
 
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
+	}
+	if c.ReadCacheSize > 0 {
+		l.readCache = newReadCache(c.ReadCacheSize)
 	}
 	return l, l.setup()
 }
 
+// OpenLog is like NewLog, but only opens an existing log:
+// it returns ErrLogNotFound if dir doesn't exist or has no segments, e.g. because it is the wrong directory.
+func OpenLog(dir string, c Config) (*Log, error) {
+	baseOffsets, err := segmentBaseOffsets(dir)
+	if os.IsNotExist(err) || (err == nil && len(baseOffsets) == 0) {
+		return nil, fmt.Errorf("%s: %w", dir, ErrLogNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewLog(dir, c)
+}
+
 // Append appends the record argument and returns the offset of the appended record.
 func (l *Log) Append(r *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), r)
+}
+
+// AppendContext is like Append, but gives up with ctx's error if ctx is done
+// before the record is appended, including while waiting for other appends to finish.
+func (l *Log) AppendContext(ctx context.Context, r *api.Record) (uint64, error) {
+	info, err := l.AppendWithMeta(ctx, r)
+	return info.Offset, err
+}
+
+// AppendBatch appends the records in order while holding the write lock once,
+// rolling to new segments as needed, and returns the offsets of the appended records.
+// If an append fails, it returns the offsets of the records appended before the failure along with the error.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	infos, err := l.AppendBatchWithMeta(records)
+	offsets := make([]uint64, len(infos))
+	for i, info := range infos {
+		offsets[i] = info.Offset
+	}
+	return offsets, err
+}
+
+// AppendBatchWithMeta is like AppendBatch, but also returns where each record was stored.
+func (l *Log) AppendBatchWithMeta(records []*api.Record) ([]AppendInfo, error) {
+	l.mu.Lock()
+	defer l.unlockAppend()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	infos := make([]AppendInfo, 0, len(records))
+	for _, r := range records {
+		info, err := l.appendWithInfo(r)
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// AppendFunc calls fn with the offset that the next appended record will be assigned,
+// and appends the record fn returns.
+// fn is called while holding the log's write lock, so no other record can be appended in between,
+// which allows records to be built from the offset they are assigned.
+// If fn returns an error, nothing is appended and the error is returned.
+func (l *Log) AppendFunc(fn func(nextOffset uint64) (*api.Record, error)) (uint64, error) {
+	l.mu.Lock()
+	defer l.unlockAppend()
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	r, err := fn(l.activeSegment.nextOffset)
+	if err != nil {
+		return 0, err
+	}
+	return l.append(r)
+}
+
+// AppendIfOffset appends the record only if it would be assigned the expected offset,
+// i.e. if no other record was appended since the caller observed the log.
+// Otherwise, it returns api.ErrOffsetConflict.
+func (l *Log) AppendIfOffset(expected uint64, r *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.unlockAppend()
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	if next := l.activeSegment.nextOffset; next != expected {
+		return 0, api.ErrOffsetConflict{Expected: expected, Actual: next}
+	}
+	return l.append(r)
+}
+
+// AppendAt appends the record at off, the offset assigned to it by another log, e.g. a replication leader.
+// off must be the log's next offset, otherwise ErrOutOfSequence is returned and nothing is appended.
+func (l *Log) AppendAt(off uint64, r *api.Record) error {
+	l.mu.Lock()
+	defer l.unlockAppend()
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if next := l.activeSegment.nextOffset; off != next {
+		return ErrOutOfSequence{Offset: off, Next: next}
+	}
+	_, err := l.append(r)
+	return err
+}
+
+// SkipTo moves the log's next offset forward to off, leaving the offsets in between without records,
+// like the offsets of compacted records. HighestOffset still returns the offset of the last record appended. It lets a replication follower keep up with a leader
+// whose log has gaps, e.g. because it was compacted or truncated, by skipping to the offset passed to the next AppendAt.
+// off must not be lower than the log's next offset, otherwise ErrOutOfSequence is returned.
+// The skip is only durable once a record is appended at off.
+func (l *Log) SkipTo(off uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	off, err := l.activeSegment.Append(r)
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+	s := l.activeSegment
+	if off < s.nextOffset {
+		return ErrOutOfSequence{Offset: off, Next: s.nextOffset}
+	}
+	// an empty log is replaced by one starting at off, so that its lowest offset is off.
+	if l.empty() {
+		if len(l.segments) > 0 {
+			l.forgetSegment(s)
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			l.segments = nil
+		}
+		return l.newSegment(off)
+	}
+	// an index entry's relative offset must fit in 32 bits, so a large enough skip starts a new segment.
+	if off-s.baseOffset > math.MaxUint32 {
+		return l.roll(off)
+	}
+	s.nextOffset = off
+	return nil
+}
+
+// AppendSync is like Append, but only returns once the record is durable,
+// i.e. once the store and index of the record's segment are synced.
+// Syncing while holding the write lock means no roll can happen between the append and the sync.
+func (l *Log) AppendSync(r *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.unlockAppend()
+	off, err := l.append(r)
 	if err != nil {
 		return 0, err
 	}
+	// the record may already be in a sealed segment if appending it rolled the log.
+	if err := l.findSegment(off).Sync(); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// AppendWithMeta is like AppendContext, but also returns where the record was stored.
+func (l *Log) AppendWithMeta(ctx context.Context, r *api.Record) (AppendInfo, error) {
+	if err := l.lockContext(ctx); err != nil {
+		return AppendInfo{}, err
+	}
+	defer l.unlockAppend()
+	return l.appendWithInfo(r)
+}
+
+// appendedRecord is a record appended while holding l.mu, which OnAppend is yet to be called with.
+type appendedRecord struct {
+	offset uint64
+	record *api.Record
+}
+
+// unlockAppend unlocks l.mu, and calls OnAppend with the records appended while holding it.
+// OnAppend's lock is acquired before l.mu is unlocked, so that OnAppend is called in append order.
+// The caller must hold l.mu.
+func (l *Log) unlockAppend() {
+	pending := l.pendingAppends
+	l.pendingAppends = nil
+	if len(pending) == 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.onAppendMu.Lock()
+	defer l.onAppendMu.Unlock()
+	l.mu.Unlock()
+	for _, a := range pending {
+		l.OnAppend(a.offset, a.record)
+	}
+}
+
+// lockContext acquires the write lock, unless ctx is done before or while waiting for it.
+// The caller must unlock l.mu if it returns nil.
+func (l *Log) lockContext(ctx context.Context) error {
+	return lockContext(ctx, l.mu.Lock, l.mu.Unlock)
+}
+
+// rlockContext is like lockContext, but acquires the read lock.
+// The caller must read unlock l.mu if it returns nil.
+func (l *Log) rlockContext(ctx context.Context) error {
+	return lockContext(ctx, l.mu.RLock, l.mu.RUnlock)
+}
+
+// lockContext calls lock, unless ctx is done before or while waiting for it.
+// A sync.RWMutex can't stop waiting, so lock is called on another goroutine,
+// which calls unlock once it acquires the lock if ctx was done in the meantime.
+func lockContext(ctx context.Context, lock, unlock func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		// ctx can't be cancelled, so there is no need to wait on another goroutine.
+		lock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// append appends r to the active segment, rolling to a new segment when the active segment is maxed.
+// The caller must hold l.mu.
+func (l *Log) append(r *api.Record) (uint64, error) {
+	info, err := l.appendWithInfo(r)
+	return info.Offset, err
+}
+
+// appendWithInfo is like append, but also returns where the record was stored.
+// The caller must hold l.mu.
+func (l *Log) appendWithInfo(r *api.Record) (AppendInfo, error) {
+	if err := l.checkOpen(); err != nil {
+		return AppendInfo{}, err
+	}
+	if l.ReadOnly {
+		return AppendInfo{}, ErrReadOnly
+	}
+	// Truncate can remove every segment, including the active one,
+	// in which case appends continue in a new segment from the removed active segment's next offset.
+	if len(l.segments) == 0 {
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return AppendInfo{}, err
+		}
+	}
+	size := uint64(proto.Size(r))
+	if max := l.Config.Segment.MaxRecordBytes; max > 0 && size > max {
+		return AppendInfo{}, ErrRecordTooLarge{Size: size, Max: max}
+	}
+	// an old segment is rolled before it is appended to, so that records are never added to it late,
+	// and a record larger than a whole store gets a segment of its own.
+	if s := l.activeSegment; s.nextOffset > s.baseOffset && (s.IsExpired() || size > l.Config.Segment.MaxStoreBytes) {
+		if err := l.roll(s.nextOffset); err != nil {
+			return AppendInfo{}, err
+		}
+	}
+	segment := l.activeSegment
+	segment.stamp(r)
+	off, pos, err := segment.appendWithPos(r)
+	// the active segment's index can be full without the log having rolled,
+	// e.g. when the log is reopened with a smaller MaxIndexBytes, in which case the record goes to a new segment.
+	if err == ErrIndexFull && segment.nextOffset > segment.baseOffset {
+		if err := l.roll(segment.nextOffset); err != nil {
+			return AppendInfo{}, err
+		}
+		segment = l.activeSegment
+		off, pos, err = segment.appendWithPos(r)
+	}
+	if err != nil {
+		return AppendInfo{}, err
+	}
+	info := AppendInfo{Offset: off, Position: pos, BaseOffset: segment.baseOffset}
+	if l.OnAppend != nil {
+		l.pendingAppends = append(l.pendingAppends, appendedRecord{offset: off, record: r})
+	}
+	l.Metrics.IncAppends()
+	l.Metrics.AddBytesWritten(segment.store.size - pos)
+	l.Metrics.SetActiveSegmentBytes(segment.store.size)
+	close(l.appended)
+	l.appended = make(chan struct{})
 	// the index is specific about how many index entries can be written,
 	// given that each index entry is a fixed size of 12 bytes (index.indexEntryWidth).
-	// i.e., if we make MaxIndexBytes a multiple of index.indexEntryWidth,
-	// there should never be an overflow.
-	// However, the store might occasionally exceed MaxStoreBytes
-	// as there is no specific cap on the record data's size.
+	// NewLog rounds MaxIndexBytes down to a multiple of index.indexEntryWidth,
+	// so there is never an overflow.
+	// A store only exceeds MaxStoreBytes by its last record, as the log rolls once the store is maxed,
+	// and a record larger than MaxStoreBytes is the only record in its segment.
 	if l.activeSegment.IsMaxed() {
 		// subsequent records will belong to the new segment.
-		err = l.newSegment(off + 1)
+		err = l.roll(off + 1)
+	}
+	return info, err
+}
+
+// roll seals the active segment and replaces it with a new segment starting at off.
+// Unless SyncOnRollover is false, the sealed segment is made durable before the new segment receives any writes,
+// so that a crash right after rolling cannot lose the sealed segment's data.
+// The segment is only sealed once the new segment is open, as sealing shrinks the index's file,
+// which the segment can't be appended to afterwards.
+// The caller must hold l.mu.
+func (l *Log) roll(off uint64) error {
+	sealed := l.activeSegment
+	if err := l.newSegment(off); err != nil {
+		return err
 	}
-	return off, err
+	if l.syncOnRollover() {
+		if err := sealed.Seal(); err != nil {
+			return err
+		}
+	}
+	return l.evictSegments()
+}
+
+// evictSegments removes the oldest segments while there are more than MaxSegments.
+// The caller must hold l.mu.
+func (l *Log) evictSegments() error {
+	max := l.Config.Log.MaxSegments
+	if max <= 0 {
+		return nil
+	}
+	for len(l.segments) > max {
+		l.forgetSegment(l.segments[0])
+		if err := l.segments[0].Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	l.Metrics.SetSegments(len(l.segments))
+	return nil
 }
 
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.ReadContext(context.Background(), off)
+}
+
+// ReadContext is like Read, but gives up with ctx's error if ctx is done
+// before the record is read, including while waiting for appends to finish.
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	if err := l.rlockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if record, ok := l.readCache.get(off); ok {
+		l.Metrics.IncReads()
+		return record, nil
+	}
+	record, _, err := l.readWithInfo(off)
+	if err == nil {
+		l.readCache.put(off, record)
+	}
+	return record, err
+}
+
+// ReadLatest returns the record with the highest offset, or ErrEmptyLog if the log has no records.
+func (l *Log) ReadLatest() (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	highest, ok := l.highestOffset()
+	if !ok {
+		return nil, ErrEmptyLog
+	}
+	record, _, err := l.readWithInfo(highest)
+	return record, err
+}
 
+// ReadNext returns the record with the lowest offset of at least off,
+// skipping the offsets without records, e.g. compacted ones, rather than reading them one by one.
+// It returns api.ErrOffsetOutOfRange if there is no such record.
+func (l *Log) ReadNext(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	for _, s := range l.segments {
+		if s.nextOffset <= off {
+			continue
+		}
+		record, err := s.readFrom(off)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		l.Metrics.IncReads()
+		return record, nil
+	}
+	return nil, l.outOfRange(off)
+}
+
+// ReadWithInfo reads the record at off, along with how the record is stored on disk,
+// e.g. its on-disk (compressed) and decoded sizes.
+func (l *Log) ReadWithInfo(off uint64) (*api.Record, ReadInfo, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, ReadInfo{}, err
+	}
+	return l.readWithInfo(off)
+}
+
+// readWithInfo reads the record at off, repairing the index entry it is read through if needed.
+// The caller must hold l.mu.
+func (l *Log) readWithInfo(off uint64) (*api.Record, ReadInfo, error) {
+	segment := l.findSegment(off)
+	if segment == nil {
+		return nil, ReadInfo{}, l.outOfRange(off)
+	}
+	return l.readSegment(segment, off)
+}
+
+// outOfRange returns the error for reading off, which has no record, along with the log's range of offsets.
+// The caller must hold l.mu.
+func (l *Log) outOfRange(off uint64) api.ErrOffsetOutOfRange {
+	err := api.ErrOffsetOutOfRange{Offset: off}
+	if len(l.segments) == 0 {
+		return err
+	}
+	err.Lowest = l.segments[0].baseOffset
+	if next := l.activeSegment.nextOffset; next > 0 {
+		err.Highest = next - 1
+	}
+	return err
+}
+
+// readSegment reads the record at off from segment, repairing the index entry it is read through if needed.
+// The caller must hold l.mu.
+func (l *Log) readSegment(segment *segment, off uint64) (*api.Record, ReadInfo, error) {
+	record, info, err := segment.ReadWithInfo(off)
+	if err == io.EOF {
+		// the segment has no index entry for off, as its record was compacted away.
+		return nil, ReadInfo{}, l.outOfRange(off)
+	}
+	if err != nil && l.ReadRepair && !l.ReadOnly && segment != l.activeSegment {
+		record, info, err = segment.repair(off)
+	}
+	if err == nil {
+		l.Metrics.IncReads()
+	}
+	return record, info, err
+}
+
+// ReadRange reads the records with offsets in [from, to), in order, under a single read lock.
+// It returns api.ErrOffsetOutOfRange if from is out of range,
+// and the records up to the highest offset if to is past it.
+func (l *Log) ReadRange(from, to uint64) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if l.findSegment(from) == nil {
+		return nil, l.outOfRange(from)
+	}
+	var records []*api.Record
+	for _, s := range l.segments {
+		if s.nextOffset <= from {
+			continue
+		}
+		if to <= s.baseOffset {
+			break
+		}
+		off := s.baseOffset
+		if off < from {
+			off = from
+		}
+		for ; off < s.nextOffset && off < to; off++ {
+			record, _, err := l.readSegment(s, off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				// off was compacted away.
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// findSegment returns the segment holding the record with offset off, or nil if there is none.
+// The caller must hold l.mu.
+func (l *Log) findSegment(off uint64) *segment {
 	var segment *segment
 	// find the segment to read from
 	for _, s := range l.segments {
@@ -78,69 +598,260 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 	// The second condition technically should not happen.
 	// It means that off is out of bounds of the segment.
 	if segment == nil || segment.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
+		return nil
+	}
+	return segment
+}
+
+// OffsetForTime returns the offset of the first record with a timestamp at or after t,
+// e.g. to read every record since a point in time. Records without timestamps are never returned.
+// If t is before every record's timestamp, it returns the lowest offset with a timestamp.
+// If t is after every record's timestamp, it returns api.ErrOffsetOutOfRange with the offset of the next record appended.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	for _, s := range l.segments {
+		if off, ok := s.offsetForTime(t); ok {
+			return off, nil
+		}
 	}
-	return segment.Read(off)
+	return 0, l.outOfRange(l.activeSegment.nextOffset)
+}
+
+// Wait blocks until the record with offset off has been appended, or ctx is done.
+// It returns immediately if the record was already appended,
+// otherwise it returns ctx's error if ctx is done first, or ErrLogClosed if the log is closed first.
+func (l *Log) Wait(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		if err := l.checkOpen(); err != nil {
+			l.mu.RUnlock()
+			return err
+		}
+		next, appended := l.activeSegment.nextOffset, l.appended
+		l.mu.RUnlock()
+		if off < next {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// Sync makes the records appended so far durable, without closing the log.
+// Every segment that wasn't sealed when the log rolled over it is synced:
+// the active segment, and the others when SyncOnRollover is false.
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		if s.sealed {
+			continue
+		}
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Close iterates over all the segments and closes them.
+// Closing a closed log does nothing, so it is safe to close a log more than once, including concurrently.
 func (l *Log) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.close()
+}
 
+// close closes the segments, unless they are already closed.
+// The caller must hold l.mu.
+func (l *Log) close() error {
+	if l.closed {
+		return nil
+	}
 	for _, s := range l.segments {
 		if err := s.Close(); err != nil {
 			return err
 		}
 	}
+	l.closed = true
+	// waiters are woken up to find the log closed.
+	close(l.appended)
+	l.appended = make(chan struct{})
 	return nil
 }
 
 // Remove removes all the log's data and closes the log.
 func (l *Log) Remove() error {
-	if err := l.Close(); err != nil {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+	return l.removeLocked()
+}
+
+// removeLocked closes the segments, removes the log's directory and forgets the segments.
+// The log is left closed, so that later calls return ErrLogClosed rather than using the removed segments.
+// The caller must hold l.mu for writing.
+func (l *Log) removeLocked() error {
+	if err := l.close(); err != nil {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment = nil, nil
+	l.readCache.clear()
+	return nil
+}
+
+// Reset removes all the log's data and replaces it with a new, empty log with the same config.
+// It returns the offset the next appended record is assigned, i.e. Config.Segment.InitialOffset,
+// e.g. for consumers to start from.
+// The write lock is held throughout, so appends and reads wait for the reset to finish.
+func (l *Log) Reset() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	if err := l.removeLocked(); err != nil {
+		return 0, err
+	}
+	l.closed = false
+	if err := l.setup(); err != nil {
+		return 0, err
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+// Clone copies the log's current data into destDir and opens a new Log there with the given config.
+// The clone is consistent as of the call, and is independent of the original log.
+func (l *Log) Clone(destDir string, c Config) (*Log, error) {
+	if err := l.copyTo(destDir); err != nil {
+		return nil, err
+	}
+	return NewLog(destDir, c)
 }
 
-// Reset removes a log and creates a new log to replace it.
-func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+// Snapshot copies the log's store and index files into destDir, creating destDir if needed,
+// while the log stays open. Appends wait for the copy to finish, while reads carry on.
+// The snapshot is consistent as of the call, and NewLog(destDir, c) opens a log identical to the log at the time.
+func (l *Log) Snapshot(destDir string) error {
+	return l.copyTo(destDir)
+}
+
+// copyTo copies every segment's store and index files into destDir, creating destDir if needed.
+func (l *Log) copyTo(destDir string) error {
+	// the read lock prevents appends (and hence segment rolls) while the segments are copied.
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
 		return err
 	}
-	return l.setup()
+	if err := os.MkdirAll(destDir, l.dirMode()); err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		if err := s.copyTo(destDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoveryStats returns the recovery actions taken on the log's segments since the log was opened.
+func (l *Log) RecoveryStats() RecoveryStats {
+	l.recoveryMu.Lock()
+	defer l.recoveryMu.Unlock()
+	return l.recovery
 }
 
 // LowestOffset returns the smallest offset in the Log.
-// i.e., the earliest store record.
+// i.e., the earliest store record, or the offset the next record is assigned if the log is empty.
+// The offsets are kept in memory, so they are still returned once the log is closed,
+// but not once it is removed, when it returns ErrLogClosed. It returns ErrEmptyLog if the log has no segments.
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if len(l.segments) == 0 {
+		if l.closed {
+			return 0, ErrLogClosed
+		}
+		return 0, ErrEmptyLog
+	}
 	return l.segments[0].baseOffset, nil
 }
 
 // HighestOffset returns the largest offset in the Log.
 // i.e., the most recent store record.
+// It returns ErrEmptyLog if the log has no records, which tells an empty log apart from one holding only offset 0,
+// including when the log starts at a nonzero Config.Segment.InitialOffset, or if it has no segments.
+// Offsets skipped by SkipTo have no records, so they are never the highest offset,
+// even though the next record is appended after them.
+// Like LowestOffset, it returns ErrLogClosed once the log is removed.
 func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	off := l.segments[len(l.segments)-1].nextOffset
-	// case where there are no records in the segment.
-	if off == 0 {
-		return 0, nil
+	if l.closed && len(l.segments) == 0 {
+		return 0, ErrLogClosed
 	}
-	return off - 1, nil
+	highest, ok := l.highestOffset()
+	if !ok {
+		return 0, ErrEmptyLog
+	}
+	return highest, nil
+}
+
+// highestOffset returns the offset of the log's most recent record, or false if the log has no records.
+// Its segments are searched from the newest, as the newest ones can be left without records by SkipTo.
+// The caller must hold l.mu.
+func (l *Log) highestOffset() (uint64, bool) {
+	if l.empty() {
+		return 0, false
+	}
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if off, ok := l.segments[i].lastOffset(); ok {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// empty returns whether the log has no records, including when it has no segments.
+// The caller must hold l.mu.
+func (l *Log) empty() bool {
+	return len(l.segments) == 0 || l.activeSegment.nextOffset == l.segments[0].baseOffset
 }
 
 // Truncate removes all logs with offset lower than the lowest argument.
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
 
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		if truncates(s, lowest) {
+			l.forgetSegment(s)
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -149,21 +860,124 @@ func (l *Log) Truncate(lowest uint64) error {
 		}
 	}
 	l.segments = segments
+	l.Metrics.SetSegments(len(l.segments))
+	return nil
+}
+
+// TruncatePreview returns the segments that Truncate(lowest) would remove, without removing anything,
+// e.g. for tooling to confirm with an operator before truncating.
+func (l *Log) TruncatePreview(lowest uint64) []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var removed []SegmentInfo
+	for _, s := range l.segments {
+		if truncates(s, lowest) {
+			removed = append(removed, s.info())
+		}
+	}
+	return removed
+}
+
+// truncates returns whether Truncate(lowest) removes s.
+func truncates(s *segment, lowest uint64) bool {
+	return s.nextOffset <= lowest+1
+}
+
+// TruncateBefore removes the segments whose newest record is older than t,
+// based on the records' timestamps. The active segment is never removed, so that the log remains writable.
+// Only the oldest segments are removed: it stops at the first segment with a record at or after t,
+// which keeps the log's offsets contiguous even if the records' timestamps aren't in order.
+func (l *Log) TruncateBefore(t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+
+	var removed int
+	for _, s := range l.segments {
+		if s == l.activeSegment || s.nextOffset == s.baseOffset {
+			break
+		}
+		newest, err := s.newestTime()
+		if err != nil {
+			return err
+		}
+		if !newest.Before(t) {
+			break
+		}
+		l.forgetSegment(s)
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		removed++
+	}
+	l.segments = l.segments[removed:]
+	l.Metrics.SetSegments(len(l.segments))
 	return nil
 }
 
 // Reader returns a Reader that is a sequential concatenation of all the log's segments' stores.
 // The Reader is used to read the entire log.
+// Records are read framed with version 0, i.e. as their length followed by the marshalled record,
+// and by its checksum if checksums are enabled, whatever version the stores are framed with.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return errReader{err}
+	}
 	readers := make([]io.Reader, len(l.segments))
 	for i, s := range l.segments {
-		readers[i] = &originReader{s.store, 0}
+		readers[i] = storeReader(s.store, s.store.start)
 	}
 	return io.MultiReader(readers...)
 }
 
+// storeReader returns a Reader of the records of s from pos on, framed with version 0.
+// Stores framed with version 0 are read as is, others have each of their records read and framed again.
+func storeReader(s *store, pos uint64) io.Reader {
+	if s.version == 0 {
+		return &originReader{s, int64(pos)}
+	}
+	return &payloadReader{store: s, pos: pos, frame: true}
+}
+
+// ReaderFrom is like Reader, but starts at the record with offset off rather than at the start of the log,
+// e.g. to resume a backup. The record's segment is read from the record's position in its store,
+// and the segments after it are read in full.
+// It returns api.ErrOffsetOutOfRange if the log has no record with offset off.
+func (l *Log) ReaderFrom(off uint64) (io.Reader, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	for i, s := range l.segments {
+		if off < s.baseOffset || s.nextOffset <= off {
+			continue
+		}
+		pos, err := s.index.Lookup(off)
+		if err == io.EOF {
+			// the segment has no index entry for off, as its record was compacted away.
+			return nil, l.outOfRange(off)
+		}
+		if err != nil {
+			return nil, err
+		}
+		readers := []io.Reader{storeReader(s.store, pos)}
+		for _, s := range l.segments[i+1:] {
+			readers = append(readers, storeReader(s.store, s.store.start))
+		}
+		return io.MultiReader(readers...), nil
+	}
+	return nil, l.outOfRange(off)
+}
+
 func (o *originReader) Read(p []byte) (int, error) {
 	n, err := o.ReadAt(p, o.off)
 	o.off += int64(n)
@@ -175,52 +989,303 @@ type originReader struct {
 	off int64 // off is the number of bytes that has been read from *store.
 }
 
+// errReader is a Reader of a closed log, whose reads fail with err.
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
+// PayloadReader returns a Reader that is a sequential concatenation of the data of all the log's records,
+// i.e. the marshalled records, without the framing they are stored with, e.g. their lengths.
+// It is meant for exporting the log to formats that frame records differently.
+func (l *Log) PayloadReader() io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return errReader{err}
+	}
+	readers := make([]io.Reader, len(l.segments))
+	for i, s := range l.segments {
+		readers[i] = &payloadReader{store: s.store, pos: s.store.start}
+	}
+	return io.MultiReader(readers...)
+}
+
+// payloadReader reads the data of a store's records, one record at a time.
+type payloadReader struct {
+	store *store
+	// pos is the position of the next record to read in the store.
+	pos uint64
+	// frame is whether each record's data is framed with version 0, rather than read on its own.
+	frame bool
+	// buf is the data of the current record that is yet to be read.
+	buf []byte
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		data, end, err := p.store.readNext(p.pos)
+		if err != nil {
+			return 0, err
+		}
+		if p.frame {
+			data = p.store.frameVersion(data, CodecNone, 0)
+		}
+		p.buf, p.pos = data, end
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// RecordIterator iterates over the records of a log in offset order, see Log.RecordReader.
+type RecordIterator struct {
+	log *Log
+	// next is the lowest offset the next record can have.
+	next uint64
+}
+
+// RecordReader returns a RecordIterator over the log's records, starting from the lowest offset.
+// Unlike Reader, the iterator yields parsed records, and skips offsets without records, e.g. compacted ones.
+func (l *Log) RecordReader() *RecordIterator {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return &RecordIterator{log: l}
+	}
+	// a log without segments has no records until the next one is appended.
+	if len(l.segments) == 0 {
+		return &RecordIterator{log: l, next: l.activeSegment.nextOffset}
+	}
+	return &RecordIterator{log: l, next: l.segments[0].baseOffset}
+}
+
+// Next returns the next record in the log, or io.EOF if there is none.
+// Records appended after io.EOF is returned are returned by subsequent calls.
+// It returns ErrLogClosed once the log is closed or removed.
+func (it *RecordIterator) Next() (*api.Record, error) {
+	it.log.mu.RLock()
+	defer it.log.mu.RUnlock()
+	if err := it.log.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range it.log.segments {
+		if s.nextOffset <= it.next {
+			continue
+		}
+		record, err := s.readFrom(it.next)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		it.next = record.Offset + 1
+		return record, nil
+	}
+	return nil, io.EOF
+}
+
+// iterateBatchSize is the number of records Iterate reads at a time, under a single read lock.
+const iterateBatchSize = 128
+
+// Iterate calls fn with each record with an offset of at least from, in offset order,
+// up to the highest offset when Iterate is called, e.g. to export the log.
+// Offsets without records, e.g. compacted ones, are skipped.
+// It stops at the first error fn returns, and returns it, unless it is ErrStopIteration, in which case it returns nil.
+// The records are read in batches, and the read lock is released before fn is called with a batch,
+// so a long iteration doesn't hold up appends, and fn may call the log's methods.
+func (l *Log) Iterate(from uint64, fn func(off uint64, r *api.Record) error) error {
+	l.mu.RLock()
+	if err := l.checkOpen(); err != nil {
+		l.mu.RUnlock()
+		return err
+	}
+	var end uint64
+	if len(l.segments) > 0 {
+		end = l.activeSegment.nextOffset
+	}
+	l.mu.RUnlock()
+
+	for next := from; next < end; {
+		records, err := l.readBatch(next, end, iterateBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, r := range records {
+			if err := fn(r.Offset, r); err != nil {
+				if err == ErrStopIteration {
+					return nil
+				}
+				return err
+			}
+		}
+		next = records[len(records)-1].Offset + 1
+	}
+	return nil
+}
+
+// readBatch reads up to n records with offsets in [from, end), in offset order, skipping offsets without records.
+func (l *Log) readBatch(from, end uint64, n int) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// the log may be closed between the batches of an iteration.
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var records []*api.Record
+	for _, s := range l.segments {
+		for len(records) < n && from < s.nextOffset {
+			record, err := s.readFrom(from)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if record.Offset >= end {
+				return records, nil
+			}
+			records = append(records, record)
+			from = record.Offset + 1
+		}
+	}
+	return records, nil
+}
+
+// checkOpen returns ErrLogClosed if the log is closed, e.g. by Close or Remove,
+// in which case its segments mustn't be used.
+// The caller must hold l.mu.
+func (l *Log) checkOpen() error {
+	if l.closed {
+		return ErrLogClosed
+	}
+	return nil
+}
+
 // newSegment creates and appends a new segment to the log's segments,
 // and sets the newly created segment as the active segment.
 func (l *Log) newSegment(off uint64) error {
-	s, err := newSegment(l.Dir, off, l.Config)
+	s, err := l.openSegment(off)
 	if err != nil {
 		return err
 	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
+	l.Metrics.SetSegments(len(l.segments))
+	l.Metrics.SetActiveSegmentBytes(s.store.size)
 	return nil
 }
 
+// openSegment opens the segment with base offset off in the log's directory,
+// reporting the recovery actions taken to open it, and any taken later on.
+func (l *Log) openSegment(off uint64) (*segment, error) {
+	s, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range s.recoveries {
+		l.recordRecovery(e)
+	}
+	s.onRecovery = l.recordRecovery
+	return s, nil
+}
+
+// recordRecovery counts and logs a recovery action, so that repairs to the log's data are never silent.
+// Read repairs happen under the read lock, hence recoveries are guarded by their own mutex.
+func (l *Log) recordRecovery(e RecoveryEvent) {
+	l.recoveryMu.Lock()
+	l.recovery.record(e)
+	l.recoveryMu.Unlock()
+	l.Logger.Printf(
+		"log: recovered segment %d in %s: %s (%d bytes)",
+		e.BaseOffset, l.Dir, e.Action, e.Bytes,
+	)
+}
+
+// forgetSegment drops the cached records of s, which is being removed or rewritten.
+// The caller must hold l.mu for writing.
+func (l *Log) forgetSegment(s *segment) {
+	l.readCache.removeRange(s.baseOffset, s.nextOffset)
+}
+
 // setup assigns the log's segments and activeSegment.
+// The caller must hold l.mu for writing, unless the log isn't shared yet, as in NewLog.
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	// the directory is created on first use, so it needn't be created beforehand.
+	if !l.ReadOnly {
+		if err := os.MkdirAll(l.Dir, l.dirMode()); err != nil {
+			return err
+		}
+	}
+	baseOffsets, err := segmentBaseOffsets(l.Dir)
 	if err != nil {
 		return err
 	}
 
-	var baseOffsets []uint64
-	// files include both index and store files
-	for _, f := range files {
-		// remove file extension
-		offsetStr := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
-		// offset returned will be an int since bitsize 0 corresponds to int type
-		offset, _ := strconv.ParseUint(offsetStr, 10, 0)
-		baseOffsets = append(baseOffsets, offset)
-	}
-
-	// sort the offsets so that the segments can be created in order
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	for _, baseOffset := range baseOffsets {
+		if err = l.newSegment(baseOffset); err != nil {
 			return err
 		}
-		// skip the store/index file to prevent double counting the offset
-		i++
 	}
 
 	if l.segments == nil {
+		if l.ReadOnly {
+			return fmt.Errorf("read-only log in %s: %w", l.Dir, ErrLogNotFound)
+		}
 		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// segmentBaseOffsets returns the base offsets of the segments in dir, in increasing order.
+func segmentBaseOffsets(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// a segment's base offset is collected once, from either its store or its index,
+	// so that a segment missing one of them, e.g. after a crash while creating it, is still opened.
+	// A missing index is rebuilt from the store's records when the segment is opened, so none of them are lost.
+	seen := make(map[uint64]bool)
+	var baseOffsets []uint64
+	for _, f := range files {
+		// directories, such as the one Compact writes to, don't hold segments.
+		if f.IsDir() {
+			continue
+		}
+		// a segment is found by its <offset>.store and <offset>.index files,
+		// and its time index is opened along with them. Anything else, e.g. a README, is left alone.
+		ext := path.Ext(f.Name())
+		if ext != ".store" && ext != ".index" {
+			continue
+		}
+		// remove file extension
+		offsetStr := strings.TrimSuffix(f.Name(), ext)
+		offset, err := strconv.ParseUint(offsetStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		if !seen[offset] {
+			seen[offset] = true
+			baseOffsets = append(baseOffsets, offset)
+		}
+	}
+
+	// sort the offsets so that the segments can be created in order
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
@@ -1,12 +1,23 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"path"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/jxofficial/proglog/api/v1"
 )
@@ -16,8 +27,30 @@ func TestLog(t *testing.T) {
 		"append and read a record": testAppendRead,
 		"read out of range":        testReadOutOfRangeErr,
 		"init existing log":        testInitExistingLog,
+		"close twice":              testCloseTwice,
+		"ignore unknown files":     testIgnoreUnknownFiles,
 		"reader":                   testReader,
 		"truncate":                 testTruncate,
+		"truncate preview":         testTruncatePreview,
+		"read with info":           testReadWithInfo,
+		"clone":                    testClone,
+		"append func":              testAppendFunc,
+		"append if offset":         testAppendIfOffset,
+		"append at":                testAppendAt,
+		"skip to":                  testSkipTo,
+		"wait":                     testWait,
+		"disk usage by time":       testDiskUsageByTime,
+		"append batch":             testAppendBatch,
+		"truncate before":          testTruncateBefore,
+		"read range":               testReadRange,
+		"sync":                     testSync,
+		"append sync":              testAppendSync,
+		"record reader":            testRecordReader,
+		"context":                  testContext,
+		"snapshot":                 testSnapshot,
+		"timestamps":               testTimestamps,
+		"payload reader":           testPayloadReader,
+		"stats":                    testStats,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "log-test")
@@ -52,6 +85,15 @@ func testReadOutOfRangeErr(t *testing.T, log *Log) {
 	require.Nil(t, record)
 	apiErr := err.(api.ErrOffsetOutOfRange)
 	require.Equal(t, uint64(1), apiErr.Offset)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(0))
+	// the error carries the log's range of offsets, so the reader can tell how far off it is.
+	_, err = log.Read(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5, Lowest: 1, Highest: 2}, err)
 }
 
 func testInitExistingLog(t *testing.T, existingLog *Log) {
@@ -84,6 +126,61 @@ func testInitExistingLog(t *testing.T, existingLog *Log) {
 	require.Equal(t, uint64(2), highest)
 }
 
+func testCloseTwice(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- log.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// segments, and their store and indexes, can be closed again on their own too.
+	s := log.segments[0]
+	require.NoError(t, s.Close())
+	require.NoError(t, s.store.Close())
+	require.NoError(t, s.index.Close())
+}
+
+func testIgnoreUnknownFiles(t *testing.T, existingLog *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := existingLog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	segments := len(existingLog.segments)
+	require.NoError(t, existingLog.Close())
+
+	junk := []string{"README.md", ".DS_Store", "backup.store", "1.index.bak"}
+	for _, name := range junk {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(existingLog.Dir, name), []byte("junk"), 0644))
+	}
+
+	newLog, err := NewLog(existingLog.Dir, existingLog.Config)
+	require.NoError(t, err)
+	require.Len(t, newLog.segments, segments)
+	highest, err := newLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+	for off := uint64(0); off <= highest; off++ {
+		_, err := newLog.Read(off)
+		require.NoError(t, err)
+	}
+	for _, name := range junk {
+		require.FileExists(t, filepath.Join(existingLog.Dir, name))
+	}
+}
+
 func testReader(t *testing.T, log *Log) {
 	r := &api.Record{
 		Value: []byte("hello world"),
@@ -117,3 +214,2477 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testTruncatePreview(t *testing.T, log *Log) {
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	segments := make(map[uint64]SegmentInfo)
+	for _, s := range log.segments {
+		segments[s.baseOffset] = s.info()
+	}
+
+	preview := log.TruncatePreview(2)
+	require.NotEmpty(t, preview)
+	// nothing is removed by the preview.
+	require.Len(t, log.segments, len(segments))
+
+	require.NoError(t, log.Truncate(2))
+	remaining := make(map[uint64]bool)
+	for _, s := range log.segments {
+		remaining[s.baseOffset] = true
+	}
+	var removed []SegmentInfo
+	for _, info := range segments {
+		if !remaining[info.BaseOffset] {
+			removed = append(removed, info)
+		}
+	}
+	require.ElementsMatch(t, removed, preview)
+}
+
+func testReadWithInfo(t *testing.T, log *Log) {
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(r)
+	require.NoError(t, err)
+
+	readRecord, info, err := log.ReadWithInfo(off)
+	require.NoError(t, err)
+	require.Equal(t, r.Value, readRecord.Value)
+
+	// the record is stored uncompressed, so both sizes are the size of the marshalled record.
+	require.Equal(t, CodecNone, info.Codec)
+	require.Equal(t, uint64(proto.Size(readRecord)), info.UncompressedBytes)
+	require.Equal(t, info.UncompressedBytes, info.CompressedBytes)
+
+	_, _, err = log.ReadWithInfo(off + 1)
+	require.Error(t, err)
+}
+
+func testClone(t *testing.T, log *Log) {
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	// enough records to span multiple segments
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(r)
+		require.NoError(t, err)
+	}
+
+	dir, err := ioutil.TempDir("", "log-clone-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clone, err := log.Clone(dir, log.Config)
+	require.NoError(t, err)
+	defer clone.Close()
+
+	for off := uint64(0); off < 3; off++ {
+		readRecord, err := clone.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, r.Value, readRecord.Value)
+	}
+
+	off, err := clone.Append(&api.Record{Value: []byte("only in clone")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// the original log is unaffected by appends to the clone.
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+	_, err = log.Read(off)
+	require.Error(t, err)
+
+	// and the original log can still be appended to.
+	off, err = log.Append(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	readRecord, err := clone.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("only in clone"), readRecord.Value)
+}
+
+func testAppendFunc(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		off, err := log.AppendFunc(func(nextOffset uint64) (*api.Record, error) {
+			return &api.Record{
+				Value: []byte(fmt.Sprintf("record %d", nextOffset)),
+			}, nil
+		})
+		require.NoError(t, err)
+
+		readRecord, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), readRecord.Value)
+	}
+
+	// nothing is appended when fn fails.
+	errStop := errors.New("stop")
+	_, err := log.AppendFunc(func(nextOffset uint64) (*api.Record, error) {
+		require.Equal(t, uint64(3), nextOffset)
+		return nil, errStop
+	})
+	require.Equal(t, errStop, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+}
+
+func testAppendAt(t *testing.T, log *Log) {
+	for off := uint64(0); off < 3; off++ {
+		require.NoError(t, log.AppendAt(off, &api.Record{Value: []byte("hello world")}))
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+
+	// a duplicate and a gap are both rejected without appending.
+	for _, off := range []uint64{2, 4} {
+		err := log.AppendAt(off, &api.Record{Value: []byte("hello world")})
+		require.Equal(t, ErrOutOfSequence{Offset: off, Next: 3}, err)
+	}
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+}
+
+func testSkipTo(t *testing.T, log *Log) {
+	// an empty log starts at the offset skipped to.
+	require.NoError(t, log.SkipTo(5))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), lowest)
+	_, err = log.HighestOffset()
+	require.Equal(t, ErrEmptyLog, err)
+	require.NoError(t, log.AppendAt(5, &api.Record{Value: []byte("hello world")}))
+
+	require.Equal(t, ErrOutOfSequence{Offset: 5, Next: 6}, log.SkipTo(5))
+	require.NoError(t, log.SkipTo(6))
+
+	// the offsets skipped over are left without records.
+	require.NoError(t, log.SkipTo(9))
+	// until a record is appended after them, the highest offset is still that of the last record.
+	requireHighest := func(want uint64) {
+		t.Helper()
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, want, highest)
+		latest, err := log.ReadLatest()
+		require.NoError(t, err)
+		require.Equal(t, want, latest.Offset)
+		require.Equal(t, want, log.Stats().HighestOffset)
+		_, err = log.DiskUsageByTime(time.Hour)
+		require.NoError(t, err)
+	}
+	requireHighest(5)
+
+	require.NoError(t, log.AppendAt(9, &api.Record{Value: []byte("hello world")}))
+	for off := uint64(6); off < 9; off++ {
+		_, err := log.Read(off)
+		require.Error(t, err)
+	}
+	read, err := log.Read(9)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), read.Offset)
+	requireHighest(9)
+
+	// likewise when the skip is too large for the active segment, and starts a new one.
+	require.NoError(t, log.SkipTo(10+math.MaxUint32))
+	requireHighest(9)
+}
+
+func testAppendIfOffset(t *testing.T, log *Log) {
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	// two writers that both observed the log when its next offset was 0.
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := log.AppendIfOffset(0, r)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var succeeded int
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		require.Equal(t, api.ErrOffsetConflict{Expected: 0, Actual: 1}, err)
+	}
+	require.Equal(t, 1, succeeded)
+
+	off, err := log.AppendIfOffset(1, r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testWait(t *testing.T, log *Log) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.Wait(ctx, 0))
+
+	done := make(chan error)
+	go func() {
+		done <- log.Wait(context.Background(), 0)
+	}()
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	// the record is already appended, so Wait returns immediately.
+	require.NoError(t, log.Wait(context.Background(), 0))
+}
+
+func TestLogSyncOnRollover(t *testing.T) {
+	enabled, disabled := true, false
+	for scenario, syncOnRollover := range map[string]*bool{
+		"sync on rollover by default": nil,
+		"sync on rollover":            &enabled,
+		"no sync on rollover":         &disabled,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-sync-on-rollover-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{SyncOnRollover: syncOnRollover}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			r := &api.Record{Value: []byte("hello world")}
+			for len(log.segments) < 2 {
+				_, err := log.Append(r)
+				require.NoError(t, err)
+			}
+			sealed := log.segments[0]
+
+			// inspect the sealed segment's files without closing the log.
+			storeInfo, err := os.Stat(sealed.store.Name())
+			require.NoError(t, err)
+			indexInfo, err := os.Stat(sealed.index.Name())
+			require.NoError(t, err)
+			if syncOnRollover == &disabled {
+				require.Equal(t, int64(0), storeInfo.Size())
+				require.Equal(t, int64(log.Config.Segment.MaxIndexBytes), indexInfo.Size())
+
+				// the segment wasn't synced when the log rolled over it, so Sync syncs it along with the active segment.
+				require.NoError(t, log.Sync())
+				storeInfo, err = os.Stat(sealed.store.Name())
+				require.NoError(t, err)
+				require.Equal(t, int64(sealed.store.size), storeInfo.Size())
+				return
+			}
+			require.Equal(t, int64(sealed.store.size), storeInfo.Size())
+			require.Equal(t, int64(sealed.index.size), indexInfo.Size())
+
+			// the sealed segment can be opened as is, e.g. after a crash.
+			s, err := newSegment(dir, sealed.baseOffset, log.Config)
+			require.NoError(t, err)
+			defer s.Close()
+			require.Equal(t, sealed.nextOffset, s.nextOffset)
+		})
+	}
+}
+
+func testStats(t *testing.T, log *Log) {
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	stats := log.Stats()
+	// each record fills a segment, so both records are in their own sealed segment,
+	// followed by an empty active segment.
+	require.Equal(t, 3, stats.Segments)
+	require.Equal(t, log.segments[0].store.size+log.segments[1].store.size, stats.StoreBytes)
+	require.True(t, stats.StoreBytes > 0)
+	require.Equal(t, uint64(2*indexEntryWidth), stats.IndexBytes)
+	require.Equal(t, uint64(0), stats.LowestOffset)
+	require.Equal(t, uint64(1), stats.HighestOffset)
+	require.Equal(t, uint64(2), stats.ActiveBaseOffset)
+}
+
+func testDiskUsageByTime(t *testing.T, log *Log) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: timestamppb.New(start.Add(time.Duration(i) * time.Hour)),
+		})
+		require.NoError(t, err)
+	}
+
+	buckets, err := log.DiskUsageByTime(time.Hour)
+	require.NoError(t, err)
+
+	var total, bucketed uint64
+	for _, s := range log.segments {
+		total += s.store.size
+	}
+	for i, b := range buckets {
+		bucketed += b.Bytes
+		if i > 0 {
+			require.True(t, buckets[i-1].Start.Before(b.Start))
+		}
+	}
+	require.Equal(t, total, bucketed)
+	// the records span multiple segments, each attributed to the hour of its newest record.
+	require.True(t, len(buckets) > 1)
+	require.Equal(t, start.Add(5*time.Hour), buckets[len(buckets)-1].Start)
+
+	// with a bucket covering every record, all bytes land in a single bucket.
+	buckets, err = log.DiskUsageByTime(24 * time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []UsageBucket{{Start: start, Bytes: total}}, buckets)
+
+	_, err = log.DiskUsageByTime(0)
+	require.Error(t, err)
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	var records []*api.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	offsets, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets)
+	// the batch spans a segment boundary.
+	require.True(t, len(log.segments) > 1)
+
+	for i, off := range offsets {
+		readRecord, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, readRecord.Value)
+	}
+}
+
+func testTruncateBefore(t *testing.T, log *Log) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: timestamppb.New(start.Add(time.Duration(i) * time.Hour)),
+		})
+		require.NoError(t, err)
+	}
+	segments := len(log.segments)
+
+	// only the segment holding the records at 0h and 1h is stale.
+	err := log.TruncateBefore(start.Add(150 * time.Minute))
+	require.NoError(t, err)
+	require.Len(t, log.segments, segments-1)
+	for off := uint64(0); off < 2; off++ {
+		_, err = log.Read(off)
+		require.Error(t, err)
+	}
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	_, err = log.Read(2)
+	require.NoError(t, err)
+
+	// the active segment is kept even if everything is stale.
+	err = log.TruncateBefore(start.Add(24 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []*segment{log.activeSegment}, log.segments)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+}
+
+func TestLogRollsByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-max-age-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := Config{Clock: func() time.Time { return now }}
+	c.Segment.MaxAge = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	appendRecord := func() uint64 {
+		off, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: timestamppb.New(now),
+		})
+		require.NoError(t, err)
+		return off
+	}
+	appendRecord()
+	now = now.Add(30 * time.Minute)
+	appendRecord()
+	require.Len(t, log.segments, 1)
+
+	now = now.Add(30 * time.Minute)
+	off := appendRecord()
+	require.Len(t, log.segments, 2)
+	require.Equal(t, off, log.activeSegment.baseOffset)
+
+	// the new segment's age, taken from its oldest record, is kept when the log is reopened.
+	require.NoError(t, log.Close())
+	now = now.Add(30 * time.Minute)
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 2)
+	require.False(t, log.activeSegment.IsExpired())
+	now = now.Add(30 * time.Minute)
+	require.True(t, log.activeSegment.IsExpired())
+}
+
+func TestLogReopensAfterCrashWithEmptyActiveSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-crash-empty-active-segment-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.MaxAge = time.Hour
+	crashed, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for len(crashed.segments) < 2 {
+		_, err := crashed.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// the log isn't closed, as if the process crashed, which leaves the new active segment's index file zero-filled.
+	require.NoError(t, crashed.Sync())
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.False(t, log.activeSegment.IsExpired())
+}
+
+func TestLogOffsetsAfterCrashWithEmptyActiveSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-crash-empty-active-segment-offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	crashed, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for len(crashed.segments) < 2 {
+		_, err := crashed.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	next := crashed.activeSegment.nextOffset
+	// the log isn't closed, as if the process crashed, which leaves the new active segment's index file zero-filled.
+	require.NoError(t, crashed.Sync())
+
+	// the zeroed entries of the active segment's index don't count as a record, as the store is empty.
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, next, log.activeSegment.nextOffset)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, next-1, highest)
+	_, err = log.Read(next)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: next, Highest: next - 1}, err)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, next, off)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(next)
+	require.NoError(t, err)
+	require.Equal(t, next, record.Offset)
+}
+
+type captureLogger struct {
+	lines []string
+}
+
+func (l *captureLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogRecoversTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &captureLogger{}
+	c := Config{Logger: logger}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	_, err = log.Append(r)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// simulate a crash in the middle of an append: a length prefix claiming more bytes than were written.
+	f, err := os.OpenFile(path.Join(dir, "0.store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	torn := make([]byte, storeRecordLenNumBytes+3)
+	enc.PutUint64(torn, 100)
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	stats := log.RecoveryStats()
+	require.Equal(t, uint64(1), stats.TornRecords)
+	require.Equal(t, uint64(len(torn)), stats.TornBytes)
+	require.Len(t, logger.lines, 1)
+	require.Contains(t, logger.lines[0], string(RecoveryTornRecord))
+
+	// the log is usable after the recovery.
+	off, err := log.Append(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	for off := uint64(0); off < 2; off++ {
+		readRecord, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, r.Value, readRecord.Value)
+	}
+}
+
+func TestLogIndexesUnindexedRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-recovery-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Logger: &captureLogger{}}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// simulate a crash after the last two records were written to the store, but before their index entries were.
+	require.NoError(t, os.Truncate(path.Join(dir, "0.index"), int64(indexEntryWidth)))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(2), log.RecoveryStats().UnindexedRecords)
+	require.Equal(t, uint64(0), log.RecoveryStats().TornRecords)
+	for i := uint64(0); i < 3; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), record.Value)
+	}
+	// the next append follows the recovered records rather than overwriting their offsets.
+	off, err := log.Append(&api.Record{Value: []byte("hello world 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestLogReadRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-repair-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Logger: &captureLogger{}}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	sealed := log.segments[0]
+	require.NotEqual(t, log.activeSegment, sealed)
+
+	// point the index entry of offset 1 at the first record instead.
+	_, want, err := sealed.index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, sealed.index.repair(1, 0))
+
+	_, err = log.Read(1)
+	require.Equal(t, ErrIndexMismatch{Offset: 1, Found: 0}, err)
+
+	log.ReadRepair = true
+	readRecord, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), readRecord.Value)
+	require.Equal(t, uint64(1), log.RecoveryStats().ReadRepairs)
+
+	// the index entry is fixed, so subsequent reads don't need repairing.
+	_, pos, err := sealed.index.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, want, pos)
+	log.ReadRepair = false
+	_, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), log.RecoveryStats().ReadRepairs)
+}
+
+func TestLogReadRepairConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-read-repair-concurrently-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Logger: &captureLogger{}, ReadRepair: true}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	sealed := log.segments[0]
+	require.NotEqual(t, log.activeSegment, sealed)
+	require.NoError(t, sealed.index.repair(1, 0))
+
+	// the repair rewrites the index entry while the other readers read the index.
+	var wg sync.WaitGroup
+	errs := make(chan error, 3*10)
+	for i := 0; i < 10; i++ {
+		for off := uint64(0); off < 3; off++ {
+			wg.Add(1)
+			go func(off uint64) {
+				defer wg.Done()
+				_, err := log.Read(off)
+				errs <- err
+			}(off)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	record, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), record.Value)
+}
+
+func testReadRange(t *testing.T, log *Log) {
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// each record fills a segment, so the ranges span segments.
+	require.Greater(t, len(log.segments), 2)
+
+	for _, tc := range []struct {
+		from, to uint64
+		want     []uint64
+	}{
+		{from: 0, to: 4, want: []uint64{0, 1, 2, 3}},
+		{from: 1, to: 3, want: []uint64{1, 2}},
+		// to past the highest offset returns what exists.
+		{from: 2, to: 10, want: []uint64{2, 3}},
+		{from: 1, to: 1, want: nil},
+	} {
+		records, err := log.ReadRange(tc.from, tc.to)
+		require.NoError(t, err)
+		var got []uint64
+		for _, r := range records {
+			require.Equal(t, []byte(fmt.Sprintf("record %d", r.Offset)), r.Value)
+			got = append(got, r.Offset)
+		}
+		require.Equal(t, tc.want, got)
+	}
+
+	_, err := log.ReadRange(4, 10)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4, Highest: 3}, err)
+}
+
+func TestLogVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-verify-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Store.ChecksumEnabled = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	problems, err := log.Verify()
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// flip the last byte of the data of the record with offset 1.
+	_, pos, err := log.activeSegment.index.Read(1)
+	require.NoError(t, err)
+	_, end, err := log.activeSegment.index.Read(2)
+	require.NoError(t, err)
+	storeName := log.activeSegment.store.Name()
+	require.NoError(t, log.Close())
+
+	f, err := os.OpenFile(storeName, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	corruptPos := int64(end - storeRecordChecksumNumBytes - 1)
+	_, err = f.ReadAt(b, corruptPos)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, corruptPos)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// point the index entry of offset 2 past the end of the store.
+	require.NoError(t, log.activeSegment.index.repair(2, 1<<20))
+
+	problems, err = log.Verify()
+	require.NoError(t, err)
+	require.Equal(t, []VerifyError{
+		{Offset: 1, Pos: pos, Err: ErrCorruptRecord{Pos: pos}},
+		{Offset: 2, Pos: 1 << 20, Err: ErrPositionOutOfRange{Pos: 1 << 20, StoreSize: log.activeSegment.store.size}},
+	}, problems)
+}
+
+func TestLogVerifyConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-verify-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// each record fills up a segment, so that the segments are verified concurrently.
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+
+	log.MaxVerifyConcurrency = 1
+	sequentialUsage, err := log.DiskUsageByTime(time.Millisecond)
+	require.NoError(t, err)
+	log.MaxVerifyConcurrency = 8
+	concurrentUsage, err := log.DiskUsageByTime(time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, sequentialUsage, concurrentUsage)
+
+	for _, i := range []int{2, 5, 9, 17} {
+		require.NoError(t, log.segments[i].index.repair(0, 1<<20))
+	}
+	log.MaxVerifyConcurrency = 1
+	sequential, err := log.Verify()
+	require.NoError(t, err)
+	require.Len(t, sequential, 4)
+	log.MaxVerifyConcurrency = 8
+	concurrent, err := log.Verify()
+	require.NoError(t, err)
+	// the problems are ordered by offset, as when verifying the segments one by one.
+	require.Equal(t, sequential, concurrent)
+}
+
+func TestLogScanSegmentsWithoutLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-scan-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.MaxVerifyConcurrency = 1
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	segments, active, err := log.segmentsSnapshot()
+	require.NoError(t, err)
+	require.Len(t, segments, 4)
+
+	// appends and truncates go ahead while a sealed segment is scanned,
+	// and a segment closed before it is scanned, as if removed by a concurrent compaction, is skipped.
+	var scanned []uint64
+	var truncated, closed error
+	log.scanSegments(segments, active, func(i int, s *segment) {
+		scanned = append(scanned, s.baseOffset)
+		if s.baseOffset != 1 {
+			return
+		}
+		done := make(chan error, 1)
+		go func() {
+			if _, err := log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				done <- err
+				return
+			}
+			done <- log.Truncate(0)
+		}()
+		select {
+		case truncated = <-done:
+		case <-time.After(time.Second):
+			truncated = errors.New("the append and truncate waited for the scan")
+		}
+		closed = segments[2].Close()
+	})
+	require.NoError(t, truncated)
+	require.NoError(t, closed)
+	require.Equal(t, []uint64{0, 1, 3}, scanned)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lowest)
+}
+
+// BenchmarkLogVerify compares verifying a log's segments one at a time and several at once.
+// The log has enough segments for every worker to verify many, and Verify reads every record of each,
+// so that the time goes into reading and checksumming records rather than starting workers.
+// Run it with -cpu to vary GOMAXPROCS, which bounds how much the workers can overlap.
+func BenchmarkLogVerify(b *testing.B) {
+	dir, err := ioutil.TempDir("", "log-verify-benchmark")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 16 * 1024
+	c.Segment.MaxIndexBytes = 16 * 1024
+	c.Store.ChecksumEnabled = true
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	defer log.Close()
+	record := &api.Record{Value: bytes.Repeat([]byte("hello world "), 10)}
+	for len(log.segments) < 256 {
+		_, err := log.Append(record)
+		require.NoError(b, err)
+	}
+	storeBytes := int64(log.Stats().StoreBytes)
+
+	for _, concurrency := range []int{1, 2, 4, 8, 0} {
+		name := fmt.Sprintf("workers=%d", concurrency)
+		if concurrency == 0 {
+			name = "workers=GOMAXPROCS"
+		}
+		b.Run(name, func(b *testing.B) {
+			log.MaxVerifyConcurrency = concurrency
+			b.SetBytes(storeBytes)
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Verify(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLogReadLatest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the records' timestamps are pinned, so that their size, and hence where the log rolls, doesn't depend on the time.
+	c := Config{Clock: func() time.Time { return time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC) }}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.ReadLatest()
+	require.Equal(t, ErrEmptyLog, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	// the last append rolled the log, so the latest record is in a sealed segment, not the empty active one.
+	latest, err := log.ReadLatest()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), latest.Offset)
+	require.Equal(t, []byte("hello world 2"), latest.Value)
+	require.Equal(t, uint64(3), log.activeSegment.baseOffset)
+}
+
+func testSync(t *testing.T, log *Log) {
+	// the record is small enough to stay in the active segment, which is only synced by Sync.
+	off, err := log.Append(&api.Record{Value: []byte("hi")})
+	require.NoError(t, err)
+	require.NoError(t, log.Sync())
+	requireSynced(t, log, off)
+}
+
+func testAppendSync(t *testing.T, log *Log) {
+	// the record is small enough to stay in the active segment, which is not synced by a plain Append.
+	off, err := log.AppendSync(&api.Record{Value: []byte("hi")})
+	require.NoError(t, err)
+	requireSynced(t, log, off)
+}
+
+// requireSynced checks that the record "hi" at off, the first record of the active segment,
+// is in the segment's files, even though the log is still open.
+func requireSynced(t *testing.T, log *Log, off uint64) {
+	t.Helper()
+	s := log.activeSegment
+	require.Equal(t, s, log.findSegment(off))
+	storeBytes, err := ioutil.ReadFile(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, s.store.size, uint64(len(storeBytes)))
+	require.Contains(t, string(storeBytes), "hi")
+
+	indexBytes, err := ioutil.ReadFile(s.index.Name())
+	require.NoError(t, err)
+	require.Equal(t, uint32(off-s.baseOffset), enc.Uint32(indexBytes[:offWidth]))
+	require.Equal(t, uint64(0), enc.Uint64(indexBytes[offWidth:indexEntryWidth]))
+}
+
+func BenchmarkLogAppend(b *testing.B) {
+	for name, sync := range map[string]bool{
+		"append":      false,
+		"append sync": true,
+	} {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log-append-benchmark")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			log, err := NewLog(dir, Config{})
+			require.NoError(b, err)
+			defer log.Close()
+
+			record := &api.Record{Value: []byte("hello world")}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if sync {
+					_, err = log.AppendSync(record)
+				} else {
+					_, err = log.Append(record)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLogCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	records := []struct {
+		key, value string
+	}{
+		{key: "a", value: "a1"},
+		{key: "b", value: "b1"},
+		{key: "a", value: "a2"},
+		{value: "no key"},
+		{key: "b", value: "b2"},
+		{key: "c", value: "c1"},
+		{key: "a", value: "a3"},
+	}
+	for _, r := range records {
+		record := &api.Record{Value: []byte(r.value)}
+		if r.key != "" {
+			record.Key = []byte(r.key)
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	require.NoError(t, log.Compact())
+
+	// only the latest value of each key survives, at its original offset.
+	want := map[uint64]string{3: "no key", 4: "b2", 5: "c1", 6: "a3"}
+	requireCompacted := func(log *Log) {
+		t.Helper()
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		for off := uint64(0); off < uint64(len(records)); off++ {
+			record, err := log.Read(off)
+			value, ok := want[off]
+			if !ok {
+				require.Equal(t, api.ErrOffsetOutOfRange{Offset: off, Lowest: lowest, Highest: highest}, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, []byte(value), record.Value)
+			require.Equal(t, off, record.Offset)
+		}
+
+		read, err := log.ReadRange(lowest, uint64(len(records)))
+		require.NoError(t, err)
+		var got []uint64
+		for _, r := range read {
+			got = append(got, r.Offset)
+		}
+		require.Equal(t, []uint64{3, 4, 5, 6}, got)
+	}
+	requireCompacted(log)
+
+	// compacting again changes nothing, and appends continue from the same offset.
+	require.NoError(t, log.Compact())
+	requireCompacted(log)
+	off, err := log.Append(&api.Record{Value: []byte("a4"), Key: []byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(records)), off)
+
+	// the compacted segments are what the log is opened from.
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	requireCompacted(log)
+}
+
+func TestLogCompactKeepsRecordsWithoutTimestamps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compact-timestamp-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.MaxIndexBytes = 1024
+	// records appended before the log stamped them have no timestamp.
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b"} {
+		_, _, err := s.appendWithPos(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, key := range []string{"a", "c", "d"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	require.NoError(t, log.Compact())
+	_, err = log.Read(0)
+	require.Error(t, err)
+	record, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), record.Value)
+	require.Nil(t, record.Timestamp)
+
+	require.NoError(t, log.MergeSegments(1024))
+	record, err = log.Read(1)
+	require.NoError(t, err)
+	require.Nil(t, record.Timestamp)
+	// records appended to the log are still stamped.
+	record, err = log.Read(2)
+	require.NoError(t, err)
+	require.NotNil(t, record.Timestamp)
+}
+
+func TestLogCompactedSegmentWithGaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compacted-segment-with-gaps-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{Logger: &captureLogger{}}
+	c.Segment.MaxStoreBytes = 256
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// every other record overwrites the same key, so the compacted segments keep only the even offsets.
+	const n = 20
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key %d", i)
+		if i%2 == 1 {
+			key = "overwritten"
+		}
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	require.NoError(t, log.Compact())
+	sealed := log.segments[0]
+	require.NotEqual(t, log.activeSegment, sealed)
+	require.Less(t, sealed.index.entries(), int(sealed.nextOffset-sealed.baseOffset))
+
+	requireRetained := func(log *Log) {
+		t.Helper()
+		for off := uint64(0); off < n-1; off++ {
+			record, err := log.Read(off)
+			if off%2 == 1 {
+				require.Error(t, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+		}
+	}
+	requireRetained(log)
+
+	// repairing an entry looks it up by offset rather than by its slot in the index.
+	_, want, err := sealed.index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, sealed.index.repair(2, 0))
+	require.Equal(t, io.EOF, sealed.index.repair(1, 0))
+	_, err = log.Read(2)
+	require.Equal(t, ErrIndexMismatch{Offset: 2, Found: 0}, err)
+	log.ReadRepair = true
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), record.Value)
+	_, pos, err := sealed.index.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, want, pos)
+	log.ReadRepair = false
+
+	// a crash while the compacted files are moved into place leaves a store without its indexes,
+	// which are rebuilt from the store's records when the log is opened.
+	require.NoError(t, log.Close())
+	for _, ext := range []string{".index", ".timeindex"} {
+		require.NoError(t, os.Remove(filepath.Join(dir, fmt.Sprintf("%d%s", sealed.baseOffset, ext))))
+	}
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	requireRetained(log)
+}
+
+func testRecordReader(t *testing.T, log *Log) {
+	it := log.RecordReader()
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// the records span segments.
+	require.Greater(t, len(log.segments), 2)
+
+	for i := uint64(0); i < 4; i++ {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, i, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func testContext(t *testing.T, log *Log) {
+	off, err := log.AppendContext(context.Background(), &api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := log.ReadContext(context.Background(), off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = log.AppendContext(ctx, &api.Record{Value: []byte("hello world")})
+	require.Equal(t, context.Canceled, err)
+	_, err = log.ReadContext(ctx, off)
+	require.Equal(t, context.Canceled, err)
+
+	// nothing was appended with the cancelled context.
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, off, highest)
+}
+
+func TestLogContextCancelledWhileWaiting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-context-cancelled-while-waiting-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// the calls wait for the write lock until their context is cancelled.
+	log.mu.Lock()
+	errs := make(chan error, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, err := log.AppendContext(ctx, &api.Record{Value: []byte("hello world")})
+		errs <- err
+	}()
+	go func() {
+		_, err := log.ReadContext(ctx, off)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			require.Equal(t, context.Canceled, err)
+		case <-time.After(time.Second):
+			t.Fatal("call didn't return when its context was cancelled")
+		}
+	}
+	log.mu.Unlock()
+
+	// the lock is released by the cancelled calls once they get it.
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, off, highest)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+}
+
+func TestLogOpensSegmentsMissingAFile(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		missing []string
+		// unindexed is the number of records whose index entries are rebuilt from their stores.
+		unindexed uint64
+	}{
+		// a crash while creating the active segment, between creating its store and its index.
+		"active segment without index": {missing: []string{"3.index"}},
+		"first segment without index":  {missing: []string{"0.index"}, unindexed: 1},
+		"segments without index":       {missing: []string{"1.index", "2.index"}, unindexed: 2},
+		"active segment without store": {missing: []string{"3.store"}},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			// each record fills a segment, leaving segments 0 to 2 with a record each, and an empty active segment 3.
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Close())
+			for _, name := range tc.missing {
+				require.NoError(t, os.Remove(filepath.Join(dir, name)))
+			}
+
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			var baseOffsets []uint64
+			for _, s := range log.segments {
+				baseOffsets = append(baseOffsets, s.baseOffset)
+			}
+			require.Equal(t, []uint64{0, 1, 2, 3}, baseOffsets)
+			// the records of a segment without an index are indexed again rather than dropped.
+			for off := uint64(0); off < 3; off++ {
+				read, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, []byte("hello world"), read.Value)
+			}
+			require.Equal(t, tc.unindexed, log.RecoveryStats().UnindexedRecords)
+			off, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), off)
+		})
+	}
+}
+
+func TestLogMaxSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Log.MaxSegments = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// each record fills a segment, so the second append rolls to a third segment, evicting the first.
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 2)
+	require.NoFileExists(t, filepath.Join(dir, "0.store"))
+	require.NoFileExists(t, filepath.Join(dir, "0.index"))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lowest)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0, Lowest: 1, Highest: 1}, err)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+func TestLogMergeSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-merge-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the records' timestamps are pinned, so that their size, and hence where the log rolls, doesn't depend on the time.
+	c := Config{Clock: func() time.Time { return time.Date(2021, 1, 1, 0, 0, 0, 500000000, time.UTC) }}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// each record fills a segment, leaving four sealed segments and an empty active segment.
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 5)
+
+	// no two segments fit in a merged segment this small.
+	require.NoError(t, log.MergeSegments(c.Segment.MaxStoreBytes))
+	require.Len(t, log.segments, 5)
+
+	require.NoError(t, log.MergeSegments(1024))
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(0), log.segments[0].baseOffset)
+	require.Equal(t, log.activeSegment, log.segments[1])
+	for _, name := range []string{"1.store", "2.index", "3.timeindex"} {
+		require.NoFileExists(t, filepath.Join(dir, name))
+	}
+
+	requireRecords := func(log *Log) {
+		t.Helper()
+		for off := uint64(0); off < 4; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, []byte(fmt.Sprintf("hello world %d", off)), record.Value)
+		}
+	}
+	requireRecords(log)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world 4")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	requireRecords(log)
+}
+
+func TestLogMergeSegmentsFailure(t *testing.T) {
+	failRename := func(n int) func(*testing.T, string) {
+		return func(t *testing.T, dir string) {
+			calls := 0
+			renameFile = func(from, to string) error {
+				calls++
+				if calls == n {
+					return errors.New("rename failed")
+				}
+				return os.Rename(from, to)
+			}
+			t.Cleanup(func() { renameFile = os.Rename })
+		}
+	}
+	for scenario, fail := range map[string]func(t *testing.T, dir string){
+		"moving the store fails": failRename(1),
+		"moving the index fails": failRename(2),
+		"removing the run fails": func(t *testing.T, dir string) {
+			require.NoError(t, os.Remove(filepath.Join(dir, "2.index")))
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-merge-failure-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{Clock: func() time.Time { return time.Date(2021, 1, 1, 0, 0, 0, 500000000, time.UTC) }}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 4; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+				require.NoError(t, err)
+			}
+
+			fail(t, dir)
+			require.Error(t, log.MergeSegments(1024))
+
+			// the log's segments are usable after the failed merge, and hold every record once reopened.
+			requireRecords := func(log *Log, n uint64) {
+				t.Helper()
+				for off := uint64(0); off < n; off++ {
+					record, err := log.Read(off)
+					require.NoError(t, err)
+					require.Equal(t, off, record.Offset)
+					require.Equal(t, []byte(fmt.Sprintf("hello world %d", off)), record.Value)
+				}
+			}
+			requireRecords(log, 4)
+			off, err := log.Append(&api.Record{Value: []byte("hello world 4")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), off)
+			require.Equal(t, len(log.segments), log.Stats().Segments)
+
+			require.NoError(t, log.Close())
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			requireRecords(log, 5)
+		})
+	}
+}
+
+func TestLogStoresCompressedValuesAsIs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Store.Compression = CodecGzip
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	value := bytes.Repeat([]byte("hello world "), 100)
+	for codec, want := range map[api.Codec]Codec{
+		api.Codec_CODEC_NONE: CodecGzip,
+		// the value is marked as compressed by the producer, so the store doesn't compress it again.
+		api.Codec_CODEC_GZIP: CodecNone,
+	} {
+		off, err := log.Append(&api.Record{Value: value, Codec: codec})
+		require.NoError(t, err)
+		read, info, err := log.ReadWithInfo(off)
+		require.NoError(t, err)
+		require.Equal(t, value, read.Value)
+		require.Equal(t, codec, read.Codec)
+		require.Equal(t, want, info.Codec)
+	}
+}
+
+// recordingLogMetrics is a LogMetrics that keeps what it is told.
+type recordingLogMetrics struct {
+	mu                 sync.Mutex
+	appends, reads     int
+	bytesWritten       uint64
+	activeSegmentBytes uint64
+	segments           int
+}
+
+func (m *recordingLogMetrics) IncAppends() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.appends++
+}
+
+func (m *recordingLogMetrics) AddBytesWritten(n uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesWritten += n
+}
+
+func (m *recordingLogMetrics) IncReads() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+}
+
+func (m *recordingLogMetrics) SetActiveSegmentBytes(n uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeSegmentBytes = n
+}
+
+func (m *recordingLogMetrics) SetSegments(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.segments = n
+}
+
+func TestLogIterate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// each record fills up a segment, so that iterating crosses segments.
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+
+	var offsets []uint64
+	err = log.Iterate(0, func(off uint64, r *api.Record) error {
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", off)), r.Value)
+		offsets = append(offsets, off)
+		// records appended while iterating are past the highest offset the iteration started with.
+		_, err := log.Append(&api.Record{Value: []byte("appended while iterating")})
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+
+	offsets = nil
+	err = log.Iterate(0, func(off uint64, r *api.Record) error {
+		offsets = append(offsets, off)
+		if off == 1 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, offsets)
+
+	errFailed := errors.New("failed")
+	offsets = nil
+	err = log.Iterate(1, func(off uint64, r *api.Record) error {
+		offsets = append(offsets, off)
+		return errFailed
+	})
+	require.Equal(t, errFailed, err)
+	require.Equal(t, []uint64{1}, offsets)
+}
+
+func TestLogOnAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the hook is only called in append order, so it needs no locking of its own.
+	var offsets []uint64
+	c := Config{}
+	c.Segment.MaxRecordBytes = 64
+	c.OnAppend = func(off uint64, r *api.Record) {
+		require.Equal(t, off, r.Offset)
+		offsets = append(offsets, off)
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+
+	// failed appends don't call the hook.
+	_, err = log.Append(&api.Record{Value: make([]byte, 128)})
+	require.Error(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := log.AppendBatch([]*api.Record{{Value: []byte("hello")}, {Value: []byte("world")}})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	want := make([]uint64, 23)
+	for i := range want {
+		want[i] = uint64(i)
+	}
+	require.Equal(t, want, offsets)
+}
+
+func TestLogMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	metrics := &recordingLogMetrics{}
+	c := Config{}
+	c.Metrics = metrics
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, 1, metrics.segments)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = log.Read(1)
+	require.NoError(t, err)
+	_, err = log.Read(3)
+	require.Error(t, err)
+
+	size := log.activeSegment.store.size
+	require.Equal(t, 3, metrics.appends)
+	require.Equal(t, size, metrics.bytesWritten)
+	require.Equal(t, size, metrics.activeSegmentBytes)
+	require.Equal(t, 1, metrics.reads)
+	require.Equal(t, 1, metrics.segments)
+}
+
+func TestLogRecordLargerThanMaxStoreBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.MaxRecordBytes = 256
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	off, err := log.Append(&api.Record{Value: bytes.Repeat([]byte("a"), 100)})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// the large record is alone in its segment.
+	s := log.findSegment(off)
+	require.Equal(t, off, s.baseOffset)
+	require.Equal(t, off+1, s.nextOffset)
+
+	_, err = log.Append(&api.Record{Value: bytes.Repeat([]byte("a"), 300)})
+	var tooLarge ErrRecordTooLarge
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, uint64(256), tooLarge.Max)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, off+1, highest)
+}
+
+func TestLogReaderFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+	second := log.segments[1]
+	// reading from the middle of the second segment.
+	from := second.baseOffset + 1
+	require.Less(t, from, second.nextOffset)
+
+	reader, err := log.ReaderFrom(from)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	for off := from; off < 6; off++ {
+		require.GreaterOrEqual(t, len(b), storeRecordLenNumBytes)
+		n := enc.Uint64(b[:storeRecordLenNumBytes])
+		b = b[storeRecordLenNumBytes:]
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[:n], record))
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", off)), record.Value)
+		b = b[n:]
+	}
+	require.Empty(t, b)
+
+	_, err = log.ReaderFrom(6)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 6, Highest: 5}, err)
+}
+
+func TestLogReaderFramesVersion0(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-reader-frames-version-0-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the stores are framed with version 1, as they are compressed.
+	c := Config{}
+	c.Store.Compression = CodecGzip
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint8(1), log.activeSegment.store.version)
+
+	value := bytes.Repeat([]byte("hello world "), 100)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+	for from, reader := range map[uint64]io.Reader{0: log.Reader(), 1: mustReaderFrom(t, log, 1)} {
+		b, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		for off := from; off < 3; off++ {
+			require.GreaterOrEqual(t, len(b), storeRecordLenNumBytes)
+			n := enc.Uint64(b[:storeRecordLenNumBytes])
+			b = b[storeRecordLenNumBytes:]
+			record := &api.Record{}
+			require.NoError(t, proto.Unmarshal(b[:n], record))
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, value, record.Value)
+			b = b[n:]
+		}
+		require.Empty(t, b)
+	}
+}
+
+func mustReaderFrom(t *testing.T, log *Log, off uint64) io.Reader {
+	t.Helper()
+	reader, err := log.ReaderFrom(off)
+	require.NoError(t, err)
+	return reader
+}
+
+func TestLogInitialOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.InitialOffset = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), lowest)
+	_, err = log.HighestOffset()
+	require.Equal(t, ErrEmptyLog, err)
+	_, err = log.ReadLatest()
+	require.Equal(t, ErrEmptyLog, err)
+	require.Equal(t, uint64(0), log.Stats().HighestOffset)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), off)
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), lowest)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), highest)
+	require.Equal(t, uint64(100), log.Stats().HighestOffset)
+	_, err = log.Read(99)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 99, Lowest: 100, Highest: 100}, err)
+}
+
+func TestLogAppendToFullIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 4 * indexEntryWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// reopened with a smaller index, the active segment's index is already full.
+	c.Segment.MaxIndexBytes = 3 * indexEntryWidth
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(0), log.activeSegment.baseOffset)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.Equal(t, uint64(3), log.activeSegment.baseOffset)
+	for i := uint64(0); i < 4; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), record.Value)
+	}
+}
+
+func TestLogReadCache(t *testing.T) {
+	for scenario, cacheSize := range map[string]int{"cache disabled": 0, "cache enabled": 2} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			c.ReadCacheSize = cacheSize
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+				require.NoError(t, err)
+			}
+
+			record, err := log.Read(1)
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world 1"), record.Value)
+			// modifying a read record doesn't modify the cached one.
+			record.Value = []byte("modified")
+
+			// the store's file is swapped for a closed one, so that reading the second time fails if it touches the file.
+			store := log.findSegment(1).store
+			file := store.file
+			closed, err := os.Open(file.Name())
+			require.NoError(t, err)
+			require.NoError(t, closed.Close())
+			store.file = closed
+			record, err = log.Read(1)
+			store.file = file
+			if cacheSize == 0 {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world 1"), record.Value)
+
+			// truncated offsets are no longer served from the cache.
+			require.NoError(t, log.Truncate(1))
+			_, err = log.Read(1)
+			require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+		})
+	}
+}
+
+func TestLogCreatesDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.FileMode = 0600
+	logDir := filepath.Join(dir, "nested", "log")
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	fi, err := os.Stat(logDir)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestLogFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.FileMode = 0600
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		fi, err := os.Stat(filepath.Join(dir, "0"+ext))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), fi.Mode().Perm(), ext)
+	}
+
+	// directories the log creates can be traversed by the owner.
+	snapshotDir := filepath.Join(dir, "snapshot")
+	require.NoError(t, log.Snapshot(snapshotDir))
+	fi, err := os.Stat(snapshotDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	for _, mode := range []os.FileMode{os.ModeDir | 0644, 0400} {
+		c.FileMode = mode
+		_, err = NewLog(dir, c)
+		require.Error(t, err, mode)
+	}
+}
+
+func TestOffsetStoreFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.FileMode = 0600
+	s, err := NewOffsetStore(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, s.Commit("billing", 1))
+	fi, err := os.Stat(filepath.Join(dir, offsetsFileName))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	s, err = NewOffsetStore(dir, c)
+	require.NoError(t, err)
+	off, err := s.Fetch("billing")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestOpenLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = OpenLog(dir, Config{})
+	require.True(t, errors.Is(err, ErrLogNotFound))
+	_, err = OpenLog(filepath.Join(dir, "missing"), Config{})
+	require.True(t, errors.Is(err, ErrLogNotFound))
+	// OpenLog doesn't create a segment in the empty directory.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = OpenLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestLogWithoutSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	// truncating past the end of the log removes every segment, including the active one.
+	require.NoError(t, log.Truncate(10))
+	require.Empty(t, log.segments)
+
+	_, err = log.LowestOffset()
+	require.Equal(t, ErrEmptyLog, err)
+	_, err = log.HighestOffset()
+	require.Equal(t, ErrEmptyLog, err)
+	_, err = log.ReadLatest()
+	require.Equal(t, ErrEmptyLog, err)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	_, err = log.OffsetForTime(time.Now())
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+	require.NoError(t, log.Sync())
+	require.Equal(t, LogStats{}, log.Stats())
+	it := log.RecordReader()
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// appends continue from the removed active segment's next offset, in a new segment.
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Len(t, log.segments, 1)
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	require.Equal(t, 1, log.Stats().Segments)
+}
+
+func TestLogUseAfterRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-use-after-remove-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// a wait for a record that is never appended returns once the log is removed.
+	waited := make(chan error, 1)
+	go func() {
+		waited <- log.Wait(context.Background(), 1)
+	}()
+	require.NoError(t, log.Remove())
+	select {
+	case err := <-waited:
+		require.Equal(t, ErrLogClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return when the log was removed")
+	}
+
+	// the removed segments are never used.
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrLogClosed, err)
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.Equal(t, ErrLogClosed, err)
+	require.Equal(t, ErrLogClosed, log.AppendAt(1, &api.Record{Value: []byte("hello world")}))
+	_, err = log.AppendFunc(func(uint64) (*api.Record, error) {
+		return &api.Record{Value: []byte("hello world")}, nil
+	})
+	require.Equal(t, ErrLogClosed, err)
+	_, err = log.ReadRange(0, 1)
+	require.Equal(t, ErrLogClosed, err)
+	_, err = log.OffsetForTime(time.Now())
+	require.Equal(t, ErrLogClosed, err)
+	require.Equal(t, ErrLogClosed, log.Sync())
+	require.Equal(t, ErrLogClosed, log.Wait(context.Background(), 1))
+	require.Equal(t, ErrLogClosed, log.Truncate(0))
+	require.Equal(t, ErrLogClosed, log.Compact())
+	require.Equal(t, LogStats{}, log.Stats())
+	_, err = log.RecordReader().Next()
+	require.Equal(t, ErrLogClosed, err)
+	_, err = log.Reader().Read(make([]byte, 1))
+	require.Equal(t, ErrLogClosed, err)
+	_, err = log.DiskUsageByTime(time.Hour)
+	require.Equal(t, ErrLogClosed, err)
+
+	// the log can be used again once it is reset.
+	_, err = log.Reset()
+	require.NoError(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, log.Remove())
+}
+
+func TestLogRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	log.StartRetention(ctx, RetentionPolicy{MaxSegments: 2, Interval: 5 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return log.Stats().Segments == 2
+	}, time.Second, 5*time.Millisecond)
+	// the newest record is kept, along with the empty active segment.
+	record, err := log.ReadLatest()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), record.Offset)
+
+	// nothing is removed once retention is stopped.
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	for i := 5; i < 8; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 5, log.Stats().Segments)
+}
+
+func TestRecoverSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// the index is lost, and the store ends with a partially written record.
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+	f, err := os.OpenFile(path.Join(dir, "0.store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, RecoverSegment(dir, 0, c))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := uint64(0); i < 5; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), record.Value)
+	}
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func TestLogReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	c.ReadOnly = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		record, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("hello world %d", i)), record.Value)
+	}
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+	require.Equal(t, uint64(2), log.Stats().HighestOffset)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, log.Truncate(1))
+	require.NoError(t, log.Close())
+
+	// the log is left as it was.
+	c.ReadOnly = false
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestLogReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Segment.InitialOffset = 16
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	next, err := log.Reset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), next)
+	_, err = log.Read(16)
+	require.Error(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, next, off)
+
+	// appends racing with a reset land either before it, and are removed, or after it, in the new log.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*50)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				errs <- err
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		_, err := log.Reset()
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), lowest)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	for off := lowest; off <= highest; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+}
+
+// TestLogResetWithConcurrentReads is meant to be run with -race.
+func TestLogResetWithConcurrentReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))})
+		require.NoError(t, err)
+	}
+
+	// a read racing with a reset either finds its record, or finds the offset out of the empty log's range.
+	// each reader stops at its first unexpected error, which is checked once the readers are done.
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := uint64(0); ; off = (off + 1) % 10 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, err := log.Read(off)
+				if _, ok := err.(api.ErrOffsetOutOfRange); err != nil && !ok {
+					errs <- err
+					return
+				}
+				if _, err = log.LowestOffset(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		_, err := log.Reset()
+		require.NoError(t, err)
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestLogAlignsMaxIndexBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-max-index-bytes-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(1020), log.Config.Segment.MaxIndexBytes)
+
+	// the first segment holds exactly 85 entries, and the next record rolls over instead of failing.
+	entries := 1020 / indexEntryWidth
+	for i := uint64(0); i <= entries; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, entries, log.activeSegment.baseOffset)
+
+	c.Segment.MaxIndexBytes = indexEntryWidth - 1
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+func testSnapshot(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	dir, err := ioutil.TempDir("", "log-snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, log.Snapshot(dir))
+
+	// records appended after the snapshot are not in it.
+	_, err = log.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+
+	snapshot, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer snapshot.Close()
+	for i := uint64(0); i < 3; i++ {
+		record, err := snapshot.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	highest, err := snapshot.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+	_, err = snapshot.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3, Highest: 2}, err)
+}
+
+func TestLogOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-offset-for-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Clock = func() time.Time { return start.Add(30 * time.Second) }
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// the timestamps are not in offset order, and the last record is stamped when it is appended.
+	for _, ts := range []*timestamppb.Timestamp{
+		timestamppb.New(start),
+		timestamppb.New(start.Add(10 * time.Second)),
+		timestamppb.New(start.Add(5 * time.Second)),
+		timestamppb.New(start.Add(20 * time.Second)),
+		nil,
+	} {
+		_, err := log.Append(&api.Record{Value: []byte("hello world"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	requireOffsets := func(log *Log) {
+		t.Helper()
+		for _, tc := range []struct {
+			t    time.Time
+			want uint64
+		}{
+			{t: start.Add(-time.Hour), want: 0},
+			{t: start, want: 0},
+			{t: start.Add(time.Second), want: 1},
+			// the record at offset 2 is earlier, but comes after a later record.
+			{t: start.Add(6 * time.Second), want: 1},
+			{t: start.Add(11 * time.Second), want: 3},
+			{t: start.Add(20 * time.Second), want: 3},
+			{t: start.Add(21 * time.Second), want: 4},
+		} {
+			got, err := log.OffsetForTime(tc.t)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got, "offset for %s", tc.t)
+		}
+		_, err := log.OffsetForTime(start.Add(31 * time.Second))
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5, Highest: 4}, err)
+	}
+	requireOffsets(log)
+
+	// the time indexes are rebuilt from the records if they are missing, e.g. for logs written before they existed.
+	require.NoError(t, log.Close())
+	timeIndexes, err := filepath.Glob(filepath.Join(dir, "*.timeindex"))
+	require.NoError(t, err)
+	require.Len(t, timeIndexes, len(log.segments))
+	for _, name := range timeIndexes {
+		require.NoError(t, os.Remove(name))
+	}
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	requireOffsets(log)
+}
+
+func testTimestamps(t *testing.T, log *Log) {
+	var previous time.Time
+	for i := 0; i < 3; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.NotNil(t, record.Timestamp)
+		ts := record.Timestamp.AsTime()
+		require.False(t, ts.IsZero())
+		require.False(t, ts.Before(previous))
+		previous = ts
+	}
+
+	// a timestamp set by the producer is kept.
+	want := timestamppb.New(time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC))
+	off, err := log.Append(&api.Record{Value: []byte("hello world"), Timestamp: want})
+	require.NoError(t, err)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(want, record.Timestamp))
+}
+
+func testPayloadReader(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	b, err := ioutil.ReadAll(log.PayloadReader())
+	require.NoError(t, err)
+
+	// the payloads are the marshalled records back to back, so each is as long as its record's marshalled size.
+	for i := uint64(0); i < 3; i++ {
+		want, err := log.Read(i)
+		require.NoError(t, err)
+		size := proto.Size(want)
+		require.GreaterOrEqual(t, len(b), size)
+
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[:size], record))
+		require.True(t, proto.Equal(want, record))
+		b = b[size:]
+	}
+	require.Empty(t, b)
+}
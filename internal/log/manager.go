@@ -0,0 +1,204 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+// topicNameRegexp matches valid topic names. A topic name is used as the name of the topic's directory,
+// so it can't hold path separators, and it can't start with a dot, which would clash with the log's own directories.
+var topicNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-][a-zA-Z0-9._-]{0,254}$`)
+
+// topicConfigsDir is the directory, within the manager's directory, that the topics' configs are saved in,
+// as <topic>.json. Its name starts with a dot, so it can't clash with a topic's directory.
+const topicConfigsDir = ".topics"
+
+// LogManager hosts multiple named logs, called topics, each in its own subdirectory of Dir.
+// It is safe for concurrent use, and operations on different topics don't wait on each other.
+// Each topic's config is saved when the topic is created, and the topic is opened with it from then on,
+// except for the config's Clock, Logger, Metrics and OnAppend, which can't be saved and are the manager's instead.
+type LogManager struct {
+	Dir string
+	// mu is write locked to add or remove topics, and read locked while using a topic's log,
+	// so that a topic isn't deleted while in use.
+	mu   sync.RWMutex
+	logs map[string]*Log
+}
+
+// NewLogManager opens the topics in dir, creating dir if needed.
+// Every subdirectory of dir with a valid topic name is opened as a topic, with the config it was created with,
+// or with config c if none was saved. The saved configs use c's Clock, Logger, Metrics and OnAppend.
+func NewLogManager(dir string, c Config) (*LogManager, error) {
+	if err := os.MkdirAll(dir, c.dirMode()); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &LogManager{
+		Dir:  dir,
+		logs: make(map[string]*Log),
+	}
+	for _, f := range files {
+		if !f.IsDir() || !topicNameRegexp.MatchString(f.Name()) {
+			continue
+		}
+		tc, err := m.topicConfig(f.Name(), c)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		l, err := NewLog(path.Join(dir, f.Name()), tc)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.logs[f.Name()] = l
+	}
+	return m, nil
+}
+
+// CreateTopic creates the topic name, with its log opened with config c, which is saved for reopening the topic.
+// It returns ErrTopicExists if the topic already exists.
+func (m *LogManager) CreateTopic(name string, c Config) (*Log, error) {
+	if !topicNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid topic name %q", name)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.logs[name]; ok {
+		return nil, ErrTopicExists{Topic: name}
+	}
+	// the config is saved first, so that the topic is never opened with another config, even after a crash.
+	if err := m.saveTopicConfig(name, c); err != nil {
+		return nil, err
+	}
+	l, err := NewLog(path.Join(m.Dir, name), c)
+	if err != nil {
+		return nil, err
+	}
+	m.logs[name] = l
+	return l, nil
+}
+
+// topicConfigPath returns the path of the file the config of the topic name is saved in.
+func (m *LogManager) topicConfigPath(name string) string {
+	return path.Join(m.Dir, topicConfigsDir, name+".json")
+}
+
+// saveTopicConfig saves c as the config of the topic name.
+func (m *LogManager) saveTopicConfig(name string, c Config) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(m.Dir, topicConfigsDir), c.dirMode()); err != nil {
+		return err
+	}
+	return writeFileAtomically(m.topicConfigPath(name), b, c.fileMode())
+}
+
+// topicConfig returns the saved config of the topic name, with c's Clock, Logger, Metrics and OnAppend,
+// or c if the topic has no saved config, e.g. because it was created before configs were saved.
+func (m *LogManager) topicConfig(name string, c Config) (Config, error) {
+	b, err := ioutil.ReadFile(m.topicConfigPath(name))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	// the fields that aren't saved are left as they are in c.
+	tc := c
+	if err := json.Unmarshal(b, &tc); err != nil {
+		return Config{}, fmt.Errorf("config of topic %q: %w", name, err)
+	}
+	return tc, nil
+}
+
+// DeleteTopic removes the topic name, along with its records.
+// It returns ErrTopicNotFound if there is no such topic.
+func (m *LogManager) DeleteTopic(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.logs[name]
+	if !ok {
+		return ErrTopicNotFound{Topic: name}
+	}
+	if err := l.Remove(); err != nil {
+		return err
+	}
+	delete(m.logs, name)
+	if err := os.Remove(m.topicConfigPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListTopics returns the names of the topics, in lexical order.
+func (m *LogManager) ListTopics() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	topics := make([]string, 0, len(m.logs))
+	for name := range m.logs {
+		topics = append(topics, name)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Topic returns the log of the topic name, or ErrTopicNotFound if there is no such topic.
+// The log is removed when the topic is deleted, after which its methods return ErrLogClosed,
+// including for callers that got it before the topic was deleted.
+func (m *LogManager) Topic(name string) (*Log, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	l, ok := m.logs[name]
+	if !ok {
+		return nil, ErrTopicNotFound{Topic: name}
+	}
+	return l, nil
+}
+
+// Append appends r to the log of topic, and returns the offset of the appended record.
+// The manager's lock isn't held while appending, so that a slow append doesn't hold up other topics.
+// If the topic is deleted meanwhile, Append returns ErrLogClosed.
+func (m *LogManager) Append(topic string, r *api.Record) (uint64, error) {
+	l, err := m.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	return l.Append(r)
+}
+
+// Read reads the record at off from the log of topic.
+// Like Append, it returns ErrLogClosed if the topic is deleted while reading.
+func (m *LogManager) Read(topic string, off uint64) (*api.Record, error) {
+	l, err := m.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	return l.Read(off)
+}
+
+// Close closes the logs of every topic.
+func (m *LogManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var firstErr error
+	for _, l := range m.logs {
+		if err := l.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
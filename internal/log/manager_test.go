@@ -0,0 +1,190 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+func TestLogManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	m, err := NewLogManager(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, m.ListTopics())
+
+	for _, topic := range []string{"orders", "payments"} {
+		_, err := m.CreateTopic(topic, c)
+		require.NoError(t, err)
+	}
+	_, err = m.CreateTopic("orders", c)
+	require.Equal(t, ErrTopicExists{Topic: "orders"}, err)
+	for _, name := range []string{"", ".merge", "a/b", "../orders"} {
+		_, err = m.CreateTopic(name, c)
+		require.Error(t, err, name)
+	}
+	require.Equal(t, []string{"orders", "payments"}, m.ListTopics())
+
+	// each topic has its own offsets, starting at 0.
+	for i, value := range []string{"order 0", "order 1"} {
+		off, err := m.Append("orders", &api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	off, err := m.Append("payments", &api.Record{Value: []byte("payment 0")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	r, err := m.Read("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 0"), r.Value)
+	r, err = m.Read("payments", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payment 0"), r.Value)
+	_, err = m.Read("payments", 1)
+	require.Error(t, err)
+
+	_, err = m.Append("refunds", &api.Record{Value: []byte("refund 0")})
+	require.Equal(t, ErrTopicNotFound{Topic: "refunds"}, err)
+	_, err = m.Read("refunds", 0)
+	require.Equal(t, ErrTopicNotFound{Topic: "refunds"}, err)
+
+	// reopening the manager opens the topics it hosted.
+	require.NoError(t, m.Close())
+	m, err = NewLogManager(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, m.ListTopics())
+	r, err = m.Read("orders", 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order 1"), r.Value)
+
+	// a log got before its topic is deleted is closed by the delete, rather than left writing to removed files.
+	orders, err := m.Topic("orders")
+	require.NoError(t, err)
+	require.NoError(t, m.DeleteTopic("orders"))
+	require.Equal(t, ErrTopicNotFound{Topic: "orders"}, m.DeleteTopic("orders"))
+	_, err = orders.Append(&api.Record{Value: []byte("order 2")})
+	require.Equal(t, ErrLogClosed, err)
+	_, err = orders.Read(0)
+	require.Equal(t, ErrLogClosed, err)
+	require.Equal(t, []string{"payments"}, m.ListTopics())
+	_, err = os.Stat(path.Join(dir, "orders"))
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = os.Stat(path.Join(dir, topicConfigsDir, "orders.json"))
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	r, err = m.Read("payments", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payment 0"), r.Value)
+	require.NoError(t, m.Close())
+}
+
+func TestLogManagerReopensTopicsWithTheirConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-manager-config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	m, err := NewLogManager(dir, c)
+	require.NoError(t, err)
+
+	small := c
+	small.Segment.MaxStoreBytes = 32
+	_, err = m.CreateTopic("small", small)
+	require.NoError(t, err)
+	_, err = m.CreateTopic("default", c)
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	// the topics are reopened with the configs they were created with, not the manager's,
+	// but with the manager's callbacks, which aren't saved.
+	var appended []uint64
+	c.OnAppend = func(offset uint64, _ *api.Record) {
+		appended = append(appended, offset)
+	}
+	m, err = NewLogManager(dir, c)
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, []string{"default", "small"}, m.ListTopics())
+
+	l, err := m.Topic("small")
+	require.NoError(t, err)
+	require.Equal(t, uint64(32), l.Config.Segment.MaxStoreBytes)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []uint64{0, 1, 2}, appended)
+	// the small segments roll over, unlike the manager's would.
+	require.Greater(t, l.Stats().Segments, 1)
+
+	l, err = m.Topic("default")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), l.Config.Segment.MaxStoreBytes)
+}
+
+func TestLogManagerFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-manager-mode-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{})
+	require.NoError(t, err)
+	defer m.Close()
+	c := Config{}
+	c.FileMode = 0600
+	_, err = m.CreateTopic("private", c)
+	require.NoError(t, err)
+
+	// the topic's saved config is as private as its records.
+	fi, err := os.Stat(path.Join(dir, topicConfigsDir, "private.json"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	fi, err = os.Stat(path.Join(dir, "private", "0.store"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestLogManagerSlowAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-manager-slow-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, Config{})
+	require.NoError(t, err)
+	defer m.Close()
+	appending := make(chan struct{})
+	unblock := make(chan struct{})
+	c := Config{}
+	c.OnAppend = func(uint64, *api.Record) {
+		close(appending)
+		<-unblock
+	}
+	_, err = m.CreateTopic("slow", c)
+	require.NoError(t, err)
+
+	appended := make(chan error, 1)
+	go func() {
+		_, err := m.Append("slow", &api.Record{Value: []byte("hello world")})
+		appended <- err
+	}()
+	<-appending
+	// creating and using another topic doesn't wait for the slow append.
+	_, err = m.CreateTopic("fast", Config{})
+	require.NoError(t, err)
+	off, err := m.Append("fast", &api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	close(unblock)
+	require.NoError(t, <-appended)
+}
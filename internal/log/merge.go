@@ -0,0 +1,156 @@
+package log
+
+import (
+	"math"
+	"os"
+	"path"
+)
+
+// mergeDir is the directory, within the log's directory, that MergeSegments writes merged segments to
+// before moving them in place of the original segments.
+const mergeDir = ".merge"
+
+// MergeSegments combines runs of adjacent sealed segments into single segments,
+// as long as the combined store of each run is at most maxMergedBytes and its index entries fit in one index,
+// e.g. to get rid of the many small segments left by rolling segments by age.
+// Records keep their offsets and order. The active segment is never merged.
+func (l *Log) MergeSegments(maxMergedBytes uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+
+	dir := path.Join(l.Dir, mergeDir)
+	if err := os.MkdirAll(dir, l.dirMode()); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// the runs are merged one by one, so that the log stays usable if merging a run fails.
+	var segments []*segment
+	for i := 0; i < len(l.segments); {
+		end := l.mergeRunEnd(i, maxMergedBytes)
+		if end-i == 1 {
+			segments = append(segments, l.segments[i])
+			i = end
+			continue
+		}
+		merged, err := l.mergeRun(l.segments[i:end], dir)
+		segments = append(segments, merged...)
+		if err != nil {
+			l.segments = append(segments, l.segments[end:]...)
+			l.Metrics.SetSegments(len(l.segments))
+			return err
+		}
+		i = end
+	}
+	l.segments = segments
+	l.Metrics.SetSegments(len(l.segments))
+	return nil
+}
+
+// mergeRunEnd returns the index right after the last segment of the run of segments starting at i
+// that can be merged into a single segment.
+// The caller must hold l.mu.
+func (l *Log) mergeRunEnd(i int, maxMergedBytes uint64) int {
+	first := l.segments[i]
+	if first == l.activeSegment {
+		return i + 1
+	}
+	storeBytes, indexBytes := first.store.size, first.index.size
+	end := i + 1
+	for ; end < len(l.segments); end++ {
+		s := l.segments[end]
+		if s == l.activeSegment ||
+			storeBytes+s.store.size > maxMergedBytes ||
+			indexBytes+s.index.size > l.Config.Segment.MaxIndexBytes ||
+			s.nextOffset-first.baseOffset > math.MaxUint32 {
+			break
+		}
+		storeBytes += s.store.size
+		indexBytes += s.index.size
+	}
+	return end
+}
+
+// mergeRun writes the records of the run of segments to a new segment in dir,
+// and moves the new segment's files in place of the run's.
+// It returns the segments to take the run's place in the log: the segment opened from the moved files,
+// or, if merging fails before the merged store is moved, the run itself.
+// Either way they hold every record of the run, even if it returns an error.
+// The caller must hold l.mu.
+func (l *Log) mergeRun(run []*segment, dir string) ([]*segment, error) {
+	first := run[0]
+	merged, err := newSegment(dir, first.baseOffset, l.Config)
+	if err != nil {
+		return run, err
+	}
+	for _, s := range run {
+		if err := s.forEach(merged.appendAt); err != nil {
+			merged.Remove()
+			return run, err
+		}
+	}
+	if err := merged.Close(); err != nil {
+		merged.Remove()
+		return run, err
+	}
+	if err := first.Close(); err != nil {
+		return l.reopenRun(run, err)
+	}
+
+	// the store is moved first. Until then the first segment's files are untouched, so it is reopened as it was,
+	// and from then on the merged store holds every record of the run, and indexes that don't match it are rebuilt.
+	// A crash before the rest of the run is removed leaves their records in two segments, rather than none.
+	if err := renameFile(merged.store.Name(), first.store.Name()); err != nil {
+		return l.reopenRun(run, err)
+	}
+	var mergeErr error
+	for _, f := range []struct{ from, to string }{
+		{merged.index.Name(), first.index.Name()},
+		{merged.timeIndex.Name(), first.timeIndex.Name()},
+	} {
+		if err := renameFile(f.from, f.to); err != nil {
+			if mergeErr == nil {
+				mergeErr = err
+			}
+			// the first segment's own index doesn't match the merged store, so it is removed to be rebuilt from it.
+			if err := os.Remove(f.to); err != nil && !os.IsNotExist(err) {
+				return l.reopenRun(run, err)
+			}
+		}
+	}
+	// the rest of the run's records are in the merged store, so the rest of the run is dropped
+	// even if removing it fails, and any files left are opened as segments overlapping the merged one,
+	// as after a crash.
+	for _, s := range run[1:] {
+		if err := s.Remove(); err != nil && mergeErr == nil {
+			mergeErr = err
+		}
+	}
+	s, err := l.openSegment(first.baseOffset)
+	if err != nil {
+		return run[:1], err
+	}
+	return []*segment{s}, mergeErr
+}
+
+// reopenRun reopens the first segment of the run, which was closed to move merged files in place of its own,
+// and returns the run with it, along with err, the error merging the run.
+// If the segment can't be reopened, it is left closed, so that using it fails,
+// but its files are left for the log to open again.
+// The caller must hold l.mu.
+func (l *Log) reopenRun(run []*segment, err error) ([]*segment, error) {
+	first, openErr := l.openSegment(run[0].baseOffset)
+	if openErr != nil {
+		return run, err
+	}
+	return append([]*segment{first}, run[1:]...), err
+}
+
+// renameFile moves files in place when merging segments. Tests replace it to make moving files fail.
+var renameFile = os.Rename
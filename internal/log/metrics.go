@@ -0,0 +1,27 @@
+package log
+
+// LogMetrics records observations about the log's operations.
+// It lets embedders back the log's metrics with the library of their choice, e.g. Prometheus,
+// without running the gRPC server.
+// Implementations must be safe for concurrent use.
+type LogMetrics interface {
+	// IncAppends increments the number of records appended to the log.
+	IncAppends()
+	// AddBytesWritten adds n to the number of bytes appended records took in the stores, framing included.
+	AddBytesWritten(n uint64)
+	// IncReads increments the number of records read from the log.
+	IncReads()
+	// SetActiveSegmentBytes sets the size of the active segment's store.
+	SetActiveSegmentBytes(n uint64)
+	// SetSegments sets the number of segments in the log.
+	SetSegments(n int)
+}
+
+// nopLogMetrics is the LogMetrics used when Config.Metrics is nil.
+type nopLogMetrics struct{}
+
+func (nopLogMetrics) IncAppends()                  {}
+func (nopLogMetrics) AddBytesWritten(uint64)       {}
+func (nopLogMetrics) IncReads()                    {}
+func (nopLogMetrics) SetActiveSegmentBytes(uint64) {}
+func (nopLogMetrics) SetSegments(int)              {}
@@ -0,0 +1,125 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+)
+
+// offsetsFileName is the name of the file, in the directory given to NewOffsetStore, that holds the committed offsets.
+// The log ignores it, so it can live in the log's directory.
+const offsetsFileName = "offsets.json"
+
+// OffsetStore persists the offsets committed by consumer groups, so that consumers can resume after restarting.
+// It is safe for concurrent use.
+type OffsetStore struct {
+	path    string
+	perm    os.FileMode
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+// NewOffsetStore opens the offsets committed to dir, e.g. the log's directory, if any were committed before.
+// The offsets file is created with c's FileMode, so that it can be given the same permissions as the log's files.
+func NewOffsetStore(dir string, c Config) (*OffsetStore, error) {
+	s := &OffsetStore{
+		path:    path.Join(dir, offsetsFileName),
+		perm:    c.fileMode(),
+		offsets: make(map[string]uint64),
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.offsets); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Commit records off as the offset of the next record group consumes.
+// It returns once the offset is durable.
+func (s *OffsetStore) Commit(group string, off uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, had := s.offsets[group]
+	s.offsets[group] = off
+	if err := s.persist(); err != nil {
+		if had {
+			s.offsets[group] = prev
+		} else {
+			delete(s.offsets, group)
+		}
+		return err
+	}
+	return nil
+}
+
+// Fetch returns the offset last committed by group, or ErrNoCommittedOffset if group has committed none.
+func (s *OffsetStore) Fetch(group string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, ok := s.offsets[group]
+	if !ok {
+		return 0, ErrNoCommittedOffset
+	}
+	return off, nil
+}
+
+// persist writes the offsets to the offsets file, see writeFileAtomically.
+// The caller must hold s.mu.
+func (s *OffsetStore) persist() error {
+	b, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.path, b, s.perm)
+}
+
+// writeFileAtomically writes b to a temporary file created with perm and renames it over the file at name,
+// so that a crash leaves either the old or the new contents, rather than a partial file.
+// It returns once the rename is durable.
+func writeFileAtomically(name string, b []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	// a temporary file left by a crash is removed, rather than truncated, so that it is created with perm.
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	return syncDir(path.Dir(name))
+}
+
+// syncDir commits the entries of dir, such as a file renamed into it, to persistent storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
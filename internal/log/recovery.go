@@ -0,0 +1,139 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/golang/protobuf/proto"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+// RecoveryAction is a repair made to a segment's files so that the segment can be used.
+type RecoveryAction string
+
+const (
+	// RecoveryTornRecord is the truncation of a partially written record from the end of a store,
+	// e.g. after a crash in the middle of a write.
+	RecoveryTornRecord RecoveryAction = "torn record truncated"
+	// RecoveryIndexEntryRepaired is the rewrite of an index entry that pointed to the wrong record,
+	// made when reading from a sealed segment with Config.ReadRepair enabled.
+	RecoveryIndexEntryRepaired RecoveryAction = "index entry repaired"
+	// RecoveryUnindexedRecord is the indexing of a complete record found past the end of a segment's index,
+	// e.g. after a crash between writing the record and its index entry.
+	RecoveryUnindexedRecord RecoveryAction = "unindexed record indexed"
+)
+
+// RecoveryEvent describes a single recovery action.
+type RecoveryEvent struct {
+	Action RecoveryAction
+	// BaseOffset is the base offset of the affected segment.
+	BaseOffset uint64
+	// Bytes is the number of bytes affected by the action.
+	Bytes uint64
+}
+
+// RecoveryStats counts the recovery actions taken since the log was opened.
+type RecoveryStats struct {
+	TornRecords      uint64
+	TornBytes        uint64
+	ReadRepairs      uint64
+	UnindexedRecords uint64
+}
+
+// record adds the event to the stats.
+func (r *RecoveryStats) record(e RecoveryEvent) {
+	switch e.Action {
+	case RecoveryTornRecord:
+		r.TornRecords++
+		r.TornBytes += e.Bytes
+	case RecoveryIndexEntryRepaired:
+		r.ReadRepairs++
+	case RecoveryUnindexedRecord:
+		r.UnindexedRecords++
+	}
+}
+
+// RecoverSegment rebuilds the index of the segment with base offset baseOffset in dir from the segment's store,
+// e.g. after the index file was lost or corrupted while the store is intact.
+// The store is scanned record by record, and each record is indexed by the offset it was appended with.
+// A partially written final record, e.g. after a crash in the middle of a write, is truncated from the store.
+// The segment's time index is removed, so that it is rebuilt from the records when the log is next opened.
+// The segment must not be open, i.e. the log must be closed, and c must be the config the log is opened with.
+func RecoverSegment(dir string, baseOffset uint64, c Config) error {
+	// the defaults are those of NewLog.
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	storeFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		os.O_RDWR|os.O_APPEND,
+		c.fileMode(),
+	)
+	if err != nil {
+		return err
+	}
+	s, err := newStore(storeFile, c)
+	if err != nil {
+		storeFile.Close()
+		return err
+	}
+	defer s.Close()
+	if _, err := s.truncateTornTail(s.start); err != nil {
+		return err
+	}
+
+	indexName := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
+	indexFile, err := os.OpenFile(indexName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, c.fileMode())
+	if err != nil {
+		return err
+	}
+	idx, err := newIndex(indexFile, c, baseOffset)
+	if err != nil {
+		indexFile.Close()
+		return err
+	}
+	err = indexStore(s, idx, baseOffset)
+	if closeErr := idx.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// indexStore writes an index entry to idx for every record in s, in the order they are stored.
+func indexStore(s *store, idx *index, baseOffset uint64) error {
+	for pos := s.start; ; {
+		data, end, err := s.readNext(pos)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(data, record); err != nil {
+			return err
+		}
+		if record.Offset < baseOffset {
+			return fmt.Errorf("record at position %d has offset %d, below the segment's base offset %d", pos, record.Offset, baseOffset)
+		}
+		err = idx.Write(record.Offset-baseOffset, pos)
+		if err == ErrIndexFull {
+			return fmt.Errorf("the store's records don't fit in an index of %d bytes", idx.maxBytes)
+		}
+		if err != nil {
+			return err
+		}
+		pos = end
+	}
+}
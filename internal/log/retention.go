@@ -0,0 +1,98 @@
+package log
+
+import (
+	"context"
+	"time"
+)
+
+// defaultRetentionInterval is how often StartRetention applies the policy when its Interval is zero.
+const defaultRetentionInterval = time.Minute
+
+// RetentionPolicy bounds how much of its history a log keeps, see Log.StartRetention.
+// Zero limits are unbounded.
+type RetentionPolicy struct {
+	// MaxBytes bounds the bytes of the segments' stores and indexes.
+	MaxBytes uint64
+	// MaxAge bounds the age of a segment's newest record.
+	MaxAge time.Duration
+	// MaxSegments bounds the number of segments.
+	MaxSegments int
+	// Interval is how often the policy is applied. It defaults to one minute.
+	Interval time.Duration
+}
+
+// StartRetention applies policy every policy.Interval in the background, until ctx is done,
+// by removing the oldest segments, along with their records, while the log exceeds any of the policy's limits.
+// The active segment is never removed, so that the log remains writable,
+// and segments are only removed from the start of the log, which keeps its offsets contiguous.
+// Failures to apply the policy are reported to Config.Logger and retried at the next interval.
+func (l *Log) StartRetention(ctx context.Context, policy RetentionPolicy) {
+	interval := policy.Interval
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := l.applyRetention(policy); err != nil {
+					l.Logger.Printf("log: applying retention in %s: %s", l.Dir, err)
+				}
+			}
+		}
+	}()
+}
+
+// applyRetention removes the oldest segments while the log exceeds any of policy's limits.
+func (l *Log) applyRetention(policy RetentionPolicy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+
+	var bytes uint64
+	for _, s := range l.segments {
+		bytes += s.store.size + s.index.size
+	}
+	for len(l.segments) > 1 {
+		oldest := l.segments[0]
+		expired, err := l.retentionExpired(oldest, policy.MaxAge)
+		if err != nil {
+			return err
+		}
+		if !expired &&
+			(policy.MaxSegments <= 0 || len(l.segments) <= policy.MaxSegments) &&
+			(policy.MaxBytes == 0 || bytes <= policy.MaxBytes) {
+			break
+		}
+		bytes -= oldest.store.size + oldest.index.size
+		l.forgetSegment(oldest)
+		if err := oldest.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+		l.Metrics.SetSegments(len(l.segments))
+	}
+	return nil
+}
+
+// retentionExpired returns whether the newest record of the sealed segment s is older than maxAge.
+// The caller must hold l.mu.
+func (l *Log) retentionExpired(s *segment, maxAge time.Duration) (bool, error) {
+	if maxAge <= 0 || s.nextOffset == s.baseOffset {
+		return false, nil
+	}
+	newest, err := s.newestTime()
+	if err != nil {
+		return false, err
+	}
+	return l.Config.now().Sub(newest) > maxAge, nil
+}
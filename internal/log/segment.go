@@ -2,10 +2,16 @@ package log
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api "github.com/jxofficial/proglog/api/v1"
 )
@@ -15,54 +21,265 @@ import (
 type segment struct {
 	store *store
 	index *index
+	// timeIndex maps the timestamps of the segment's records to their offsets.
+	timeIndex *timeIndex
 	// if baseOffset = x, it means the store for this segment holds records
 	// with record numbers starting from x. i.e., it is the offset from the first store record (offset 0),
 	// nextOffset refers to offset of the next record to be added to this segment's store,
 	// also with reference to the first store record (offset 0).
 	baseOffset, nextOffset uint64
 	config                 Config
+	// createdAt is when the segment was created, which is used to roll segments by age.
+	createdAt time.Time
+	// recoveries are the recovery actions taken when the segment was opened.
+	recoveries []RecoveryEvent
+	// onRecovery is called with every recovery action taken after the segment was opened.
+	onRecovery func(RecoveryEvent)
+	// repairMu serializes read repairs of the segment's index.
+	repairMu sync.Mutex
+	// sealed is whether Seal made the segment durable, after which it isn't appended to, so it needs no syncing.
+	sealed bool
+	// scanMu is read locked while the segment is scanned without the log's lock, see Log.scanSegments,
+	// and write locked by Close, so that the segment isn't closed while it is scanned.
+	scanMu sync.RWMutex
+	// closed is whether Close closed the segment, after which it isn't scanned.
+	closed bool
 }
 
 // Append appends a record to the store and writes the corresponding index entry.
 // It returns the offset of the appended record, and err if any.
 func (s *segment) Append(r *api.Record) (offset uint64, err error) {
+	s.stamp(r)
+	offset, _, err = s.appendWithPos(r)
+	return offset, err
+}
+
+// stamp stamps r with when it is appended, unless the producer set a timestamp.
+// Only new records are stamped, so that records copied with appendAt, e.g. when compacting, are stored as they were.
+func (s *segment) stamp(r *api.Record) {
+	if r.Timestamp == nil {
+		r.Timestamp = timestamppb.New(s.config.now())
+	}
+}
+
+// appendWithPos is like Append, but also returns the position of the record in the store,
+// and doesn't stamp the record.
+func (s *segment) appendWithPos(r *api.Record) (offset uint64, pos uint64, err error) {
 	curr := s.nextOffset
 	r.Offset = curr
 
 	p, err := proto.Marshal(r)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	_, pos, err := s.store.Append(p)
+	// a value the producer already compressed is not worth compressing again.
+	compression := s.store.compression
+	if r.Codec != api.Codec_CODEC_NONE {
+		compression = CodecNone
+	}
+	_, pos, err = s.store.appendCompressed(p, compression)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
+	// the append either succeeds as a whole or is rolled back,
+	// so that the store and the indexes stay consistent and the append can be retried, e.g. once the disk has space.
 	indexRelativeOffset := s.nextOffset - s.baseOffset
-	err = s.index.Write(uint32(indexRelativeOffset), pos)
+	err = s.index.Write(indexRelativeOffset, pos)
 	if err != nil {
-		return 0, err
+		return 0, 0, s.rollback(pos, false, err)
+	}
+	if r.Timestamp != nil {
+		if err = s.timeIndex.Write(indexRelativeOffset, r.Timestamp.AsTime()); err != nil {
+			return 0, 0, s.rollback(pos, true, err)
+		}
 	}
 
 	s.nextOffset++
-	return curr, nil
+	return curr, pos, nil
 }
 
-// Read takes in the segment's index's relative offset and returns the corresponding *api.Record.
-func (s *segment) Read(off uint64) (*api.Record, error) {
-	indexRelativeOffset := int64(off - s.baseOffset)
-	_, pos, err := s.index.Read(indexRelativeOffset)
+// rollback removes the record appended to the store at pos, along with its index entry if indexed,
+// after the append failed with err. It returns err, or the error rolling back if that fails too.
+func (s *segment) rollback(pos uint64, indexed bool, err error) error {
+	if indexed {
+		s.index.removeLast()
+	}
+	if rerr := s.store.rollback(pos); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// appendAt appends r keeping its offset, which must not be lower than the segment's next offset.
+// The offsets skipped over are left without records, e.g. when compacting a segment.
+func (s *segment) appendAt(r *api.Record) error {
+	if r.Offset < s.nextOffset {
+		return fmt.Errorf("offset %d is lower than the segment's next offset %d", r.Offset, s.nextOffset)
+	}
+	next := s.nextOffset
+	s.nextOffset = r.Offset
+	if _, _, err := s.appendWithPos(r); err != nil {
+		s.nextOffset = next
+		return err
+	}
+	return nil
+}
+
+// forEach calls fn with each record in the segment, in offset order, stopping at the first error.
+// Unlike reading every offset between the base and next offset, it skips offsets without records.
+func (s *segment) forEach(fn func(*api.Record) error) error {
+	for i := uint64(0); i < s.index.size/indexEntryWidth; i++ {
+		out, pos, err := s.index.Read(int64(i))
+		if err != nil {
+			return err
+		}
+		record, _, err := s.readAt(s.baseOffset+uint64(out), pos)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrom returns the first record in the segment with an offset of at least off,
+// or io.EOF if there is none.
+func (s *segment) readFrom(off uint64) (*api.Record, error) {
+	n := s.index.search(off)
+	if n == s.index.entries() {
+		return nil, io.EOF
+	}
+	out, pos, err := s.index.Read(int64(n))
 	if err != nil {
 		return nil, err
 	}
-	p, err := s.store.Read(pos)
+	record, _, err := s.readAt(s.baseOffset+uint64(out), pos)
+	return record, err
+}
+
+// Read takes in the record's offset and returns the corresponding *api.Record.
+func (s *segment) Read(off uint64) (*api.Record, error) {
+	record, _, err := s.ReadWithInfo(off)
+	return record, err
+}
+
+// ReadWithInfo is like Read, but also returns how the record is stored in the segment's store.
+func (s *segment) ReadWithInfo(off uint64) (*api.Record, ReadInfo, error) {
+	pos, err := s.index.Lookup(off)
 	if err != nil {
-		return nil, err
+		return nil, ReadInfo{}, err
+	}
+	return s.readAt(off, pos)
+}
+
+// readAt reads the record at pos in the store, and checks that it is the record with offset off.
+func (s *segment) readAt(off, pos uint64) (*api.Record, ReadInfo, error) {
+	p, info, err := s.store.ReadWithInfo(pos)
+	if err != nil {
+		return nil, ReadInfo{}, err
 	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, ReadInfo{}, err
+	}
+	if record.Offset != off {
+		return nil, ReadInfo{}, ErrIndexMismatch{Offset: off, Found: record.Offset}
+	}
+	return record, info, nil
+}
+
+// repair reads the record with offset off by walking the store instead of trusting the index,
+// and rewrites the record's index entry with the position found.
+// It must only be used on sealed segments, as it relies on the store's records being in offset order.
+func (s *segment) repair(off uint64) (*api.Record, ReadInfo, error) {
+	s.repairMu.Lock()
+	defer s.repairMu.Unlock()
+
+	pos, err := s.position(off)
+	if err != nil {
+		return nil, ReadInfo{}, err
+	}
+	record, info, err := s.readAt(off, pos)
+	if err != nil {
+		return nil, ReadInfo{}, err
+	}
+	if err = s.index.repair(off-s.baseOffset, pos); err != nil {
+		return nil, ReadInfo{}, err
+	}
+	if s.onRecovery != nil {
+		s.onRecovery(RecoveryEvent{
+			Action:     RecoveryIndexEntryRepaired,
+			BaseOffset: s.baseOffset,
+			Bytes:      indexEntryWidth,
+		})
+	}
+	return record, info, nil
+}
+
+// position returns the position in the store of the record with offset off,
+// by walking the store's records from the start of the store rather than trusting the index.
+// Records are looked up by their offset, as the store's offsets aren't contiguous once the segment is compacted.
+// It returns io.EOF if the store has no record with offset off.
+func (s *segment) position(off uint64) (uint64, error) {
+	for pos := s.store.start; ; {
+		data, end, err := s.store.readNext(pos)
+		if err != nil {
+			return 0, err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(data, record); err != nil {
+			return 0, err
+		}
+		if record.Offset == off {
+			return pos, nil
+		}
+		if record.Offset > off {
+			return 0, io.EOF
+		}
+		pos = end
+	}
+}
+
+// lastOffset returns the offset of the segment's last record, or false if the segment has no records.
+// It is below nextOffset-1 if the offsets after the last record were skipped, see Log.SkipTo.
+func (s *segment) lastOffset() (uint64, bool) {
+	out, _, err := s.index.Read(-1)
+	if err != nil {
+		return 0, false
+	}
+	return s.baseOffset + uint64(out), true
+}
+
+// newestTime returns the timestamp of the segment's newest record,
+// or the store file's modification time if the record has no timestamp.
+// The segment must have a record.
+func (s *segment) newestTime() (time.Time, error) {
+	off, ok := s.lastOffset()
+	if !ok {
+		return time.Time{}, io.EOF
+	}
+	record, err := s.Read(off)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if record.Timestamp != nil {
+		return record.Timestamp.AsTime(), nil
+	}
+	fi, err := s.store.file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// IsExpired returns whether the segment is older than the configured max age.
+func (s *segment) IsExpired() bool {
+	maxAge := s.config.Segment.MaxAge
+	return maxAge > 0 && s.config.now().Sub(s.createdAt) >= maxAge
 }
 
 // IsMaxed returns whether the segment has reached its max size
@@ -72,6 +289,39 @@ func (s *segment) IsMaxed() bool {
 		s.index.size >= s.config.Segment.MaxIndexBytes
 }
 
+// Sync makes the segment's store and index durable, without closing them.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
+// offsetForTime returns the offset of the first record in the segment with a timestamp at or after t,
+// and whether there is one.
+func (s *segment) offsetForTime(t time.Time) (uint64, bool) {
+	return s.timeIndex.Lookup(t)
+}
+
+// Seal makes the segment's store and index durable once the segment stops receiving appends,
+// i.e. when the log rolls to a new segment.
+func (s *segment) Seal() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Seal(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Seal(); err != nil {
+		return err
+	}
+	s.sealed = true
+	return nil
+}
+
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
@@ -79,6 +329,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
@@ -87,33 +340,97 @@ func (s *segment) Remove() error {
 
 // Close closes the index and store files and flushes the data into persistent storage,
 // i.e. the respective index and store files.
+// Closing a closed segment does nothing, as the store and indexes ignore repeated closes.
+// It waits for a scan of the segment to finish, see pin.
 func (s *segment) Close() error {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	s.closed = true
 	if err := s.index.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// pin keeps the segment from being closed until unpin is called, so that it can be scanned without the log's lock.
+// It returns false, without pinning the segment, if the segment is already closed.
+func (s *segment) pin() bool {
+	s.scanMu.RLock()
+	if s.closed {
+		s.scanMu.RUnlock()
+		return false
+	}
+	return true
+}
+
+// unpin releases the segment after pin.
+func (s *segment) unpin() {
+	s.scanMu.RUnlock()
+}
+
+// copyTo copies the segment's store and index files into dir.
+// The copied index is truncated to the index's size, just like index.Close does,
+// so that a segment opened from dir has the same nextOffset.
+// The caller must ensure that nothing is appended to the segment while it is being copied.
+func (s *segment) copyTo(dir string) error {
+	if err := s.store.Flush(); err != nil {
+		return err
+	}
+	storeFile, err := os.OpenFile(
+		path.Join(dir, filepath.Base(s.store.Name())),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		s.config.fileMode(),
+	)
+	if err != nil {
+		return err
+	}
+	defer storeFile.Close()
+	if _, err = io.Copy(storeFile, io.NewSectionReader(s.store, 0, int64(s.store.size))); err != nil {
+		return err
+	}
+	if err = storeFile.Sync(); err != nil {
+		return err
+	}
+
+	for _, idx := range []*index{s.index, s.timeIndex.index} {
+		if err = ioutil.WriteFile(
+			path.Join(dir, filepath.Base(idx.Name())),
+			idx.mmap[:idx.size],
+			s.config.fileMode(),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
 	}
 	var err error
+	storeFlag, indexFlag := os.O_RDWR|os.O_CREATE|os.O_APPEND, os.O_RDWR|os.O_CREATE
+	if c.ReadOnly {
+		storeFlag, indexFlag = os.O_RDONLY, os.O_RDONLY
+	}
 
 	// creating the store
 	storeFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
+		storeFlag,
+		c.fileMode(),
 	)
 	if err != nil {
 		return nil, err
 	}
-	s.store, err = newStore(storeFile)
+	s.store, err = newStore(storeFile, c)
 	if err != nil {
 		return nil, err
 	}
@@ -121,38 +438,204 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	// creating the index
 	indexFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
-		0644,
+		indexFlag,
+		c.fileMode(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.index, err = newIndex(indexFile, c, baseOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	// creating the time index
+	timeIndexName := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex"))
+	_, err = os.Stat(timeIndexName)
+	timeIndexExisted := err == nil
+	if !timeIndexExisted && c.ReadOnly {
+		return nil, fmt.Errorf("segment %d has no time index, which can't be built while read-only", baseOffset)
+	}
+	timeIndexFile, err := os.OpenFile(
+		timeIndexName,
+		indexFlag,
+		c.fileMode(),
 	)
 	if err != nil {
 		return nil, err
 	}
-	s.index, err = newIndex(indexFile, c)
+	idx, err := newIndex(timeIndexFile, c, baseOffset)
 	if err != nil {
 		return nil, err
 	}
+	s.timeIndex = &timeIndex{idx}
+
+	// an entry pointing outside of the store's records was never completed, e.g. the zeroed first entry
+	// of an empty segment's index after a crash, and neither are the time index entries of the records past it.
+	s.index.truncateAt(func(n int) bool {
+		pos := s.index.entryPos(n)
+		return s.store.start <= pos && pos < s.store.size
+	})
+	indexedEnd := s.baseOffset
+	if n := s.index.entries(); n > 0 {
+		indexedEnd = s.index.entryOffset(n-1) + 1
+	}
+	s.timeIndex.truncateAt(func(n int) bool {
+		return s.timeIndex.entryOffset(n) < indexedEnd
+	})
 
 	// if index is empty, it means the next offset is the same as the segment's base offset
-	if off, _, err := s.index.Read(-1); err != nil {
+	// and that the store should have no records.
+	end := s.store.start
+	indexed := false
+	if off, pos, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset
 	} else {
 		// add base + relative offset
 		// eg if segment starts from record 10, and index file alr has two records of relative offset 0 and 1,
 		// the next record to be added has an offset of 10 + 1 + 1 = 12.
 		s.nextOffset = baseOffset + uint64(off) + 1
+		end, indexed = pos, true
+	}
+
+	// a crash in the middle of an append can leave the store ahead of the index.
+	if !c.ReadOnly {
+		if err = s.recoverTail(end, indexed, timeIndexExisted); err != nil {
+			return nil, err
+		}
+	}
+
+	// segments written before time indexes were added have none, so it is built from their records.
+	if !timeIndexExisted && s.nextOffset > baseOffset {
+		err = s.forEach(func(r *api.Record) error {
+			if r.Timestamp == nil {
+				return nil
+			}
+			return s.timeIndex.Write(r.Offset-s.baseOffset, r.Timestamp.AsTime())
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.createdAt, err = s.oldestTime(); err != nil {
+		return nil, err
 	}
 
 	return s, nil
 }
 
-// nearestMultiple returns the nearest and lesser multiple of k in j
-// e.g. nearestMultiple(9,4) returns 8.
+// recoverTail brings the store in line with the index after a crash left records in the store past the last indexed one,
+// which is at pos if indexed, and otherwise the store is expected to start at pos.
+// A partially written record is truncated. Complete records are indexed, along with their timestamps if timeIndexed,
+// unless they can't be, e.g. because the index is full, in which case they are truncated as well.
+// The caller must have set nextOffset from the index.
+func (s *segment) recoverTail(pos uint64, indexed, timeIndexed bool) error {
+	torn, err := s.store.truncateTornTail(pos)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		if _, pos, err = s.store.readNext(pos); err == io.EOF {
+			pos = s.store.size
+		} else if err != nil {
+			return err
+		}
+	}
+	var unindexed uint64
+	for pos < s.store.size {
+		ok, end, err := s.indexRecordAt(pos, timeIndexed)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			torn += s.store.size - pos
+			if err := s.store.rollback(pos); err != nil {
+				return err
+			}
+			break
+		}
+		unindexed++
+		pos = end
+	}
+
+	if torn > 0 {
+		s.recoveries = append(s.recoveries, RecoveryEvent{
+			Action:     RecoveryTornRecord,
+			BaseOffset: s.baseOffset,
+			Bytes:      torn,
+		})
+	}
+	for i := uint64(0); i < unindexed; i++ {
+		s.recoveries = append(s.recoveries, RecoveryEvent{
+			Action:     RecoveryUnindexedRecord,
+			BaseOffset: s.baseOffset,
+			Bytes:      indexEntryWidth,
+		})
+	}
+	return nil
+}
+
+// indexRecordAt writes the index entries of the complete record at pos in the store, which has no index entry,
+// and returns the position of the record after it.
+// It returns false if the record can't be indexed: if it can't be parsed, doesn't follow the indexed records,
+// or the index is full.
+func (s *segment) indexRecordAt(pos uint64, timeIndexed bool) (ok bool, end uint64, err error) {
+	data, end, err := s.store.readNext(pos)
+	if _, corrupt := err.(ErrCorruptRecord); corrupt {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(data, record); err != nil || record.Offset < s.nextOffset {
+		return false, 0, nil
+	}
+	rel := record.Offset - s.baseOffset
+	err = s.index.Write(rel, pos)
+	if _, tooLarge := err.(ErrOffsetTooLarge); tooLarge || err == ErrIndexFull {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	if timeIndexed && record.Timestamp != nil {
+		if err := s.timeIndex.Write(rel, record.Timestamp.AsTime()); err != nil {
+			return false, 0, err
+		}
+	}
+	s.nextOffset = record.Offset + 1
+	return true, end, nil
+}
+
+// oldestTime returns when the segment was created, as far as can be told from its files:
+// the timestamp of its oldest record, or the store file's modification time if the record has no timestamp or can't be read.
+// An empty segment is considered created now.
+func (s *segment) oldestTime() (time.Time, error) {
+	if s.nextOffset == s.baseOffset {
+		return s.config.now(), nil
+	}
+	// the first index entry is used rather than the base offset, whose record may have been compacted away.
+	// A first record that can't be read, e.g. as a crash left the index ahead of the store,
+	// doesn't fail opening the segment, and the store file's modification time is used instead.
+	if out, pos, err := s.index.Read(0); err == nil {
+		record, _, err := s.readAt(s.baseOffset+uint64(out), pos)
+		if err == nil && record.Timestamp != nil {
+			return record.Timestamp.AsTime(), nil
+		}
+	}
+	fi, err := s.store.file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// nearestMultiple returns the nearest multiple of k that is lesser than or equal to j,
+// e.g. nearestMultiple(9,4) returns 8. It is used to align sizes to a whole number of index entries.
+// As j and k are unsigned, this is plain integer division, which already rounds down.
 // k is assumed to be positive (non-zero).
 func nearestMultiple(j, k uint64) uint64 {
-	if j >= 0 {
-		return (j / k) * k
-	}
-	// todo: figure out the logic behind this
-	// given that both j and k are uint, this condition should never be reached.
-	return ((j - k + 1) / k) * k
+	return (j / k) * k
 }
@@ -1,6 +1,9 @@
 package log
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -35,9 +38,12 @@ func TestSegment(t *testing.T) {
 		require.Equal(t, want.Value, got.Value)
 	}
 
+	size := s.store.size
 	_, err = s.Append(want)
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, ErrIndexFull, err)
 	require.True(t, s.IsMaxed())
+	// the record is not left in the store without an index entry.
+	require.Equal(t, size, s.store.size)
 
 	// test maxed store bytes
 	c = Config{}
@@ -55,3 +61,71 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+// failingWriter writes half of each write to w, then fails as if the disk were full.
+type failingWriter struct {
+	w io.Writer
+}
+
+func (f failingWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, errDiskFull
+}
+
+var errDiskFull = errors.New("no space left on device")
+
+func TestSegmentAppendRollsBackFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.store.Flush())
+	size, indexSize := s.store.size, s.index.size
+
+	// the record doesn't fit in the buffer, so it is written to the file straight away.
+	s.store.buf = bufio.NewWriterSize(failingWriter{s.store.file}, 16)
+	large := &api.Record{Value: bytes.Repeat([]byte("hello world "), 10)}
+	_, err = s.Append(large)
+	require.Equal(t, errDiskFull, err)
+	require.Equal(t, uint64(17), s.nextOffset)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, indexSize, s.index.size)
+	fi, err := s.store.file.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(size), fi.Size())
+
+	// the retry appends the record as if the failed append never happened.
+	off, err := s.Append(large)
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), off)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, large.Value, got.Value)
+	require.Empty(t, s.verify())
+}
+
+func TestNearestMultiple(t *testing.T) {
+	for _, tc := range []struct {
+		j, k, want uint64
+	}{
+		{j: 9, k: 4, want: 8},
+		{j: 8, k: 4, want: 8},
+		{j: 3, k: 4, want: 0},
+		{j: 0, k: 4, want: 0},
+		{j: 1024, k: indexEntryWidth, want: 1020},
+		{j: 1020, k: indexEntryWidth, want: 1020},
+	} {
+		require.Equal(t, tc.want, nearestMultiple(tc.j, tc.k), "nearestMultiple(%d, %d)", tc.j, tc.k)
+	}
+}
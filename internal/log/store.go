@@ -2,121 +2,637 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/tysonmote/gommap"
 )
 
-// Record refers to RecordData + RecordLength (8 bytes).
+// Record refers to RecordData + RecordLength (8 bytes),
+// followed by the RecordData's checksum (4 bytes) if checksums are enabled.
+// That is the version 0 framing, which store files without a header are framed with.
+// Store files framed with a later version start with a header holding the version,
+// and their records are preceded by the RecordData's codec (1 byte), whether compressed or not.
 // Size and length is used interchangeably.
 // RecordData refers to only the raw data.
 
 var (
 	enc = binary.BigEndian
+	// crcTable is the CRC-32 (Castagnoli) table used to checksum record data.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 const (
-	storeRecordLenNumBytes = 8
+	storeRecordLenNumBytes      = 8
+	storeRecordChecksumNumBytes = 4
+	storeRecordCodecNumBytes    = 1
+	storeFileVersionNumBytes    = 1
 )
 
+// storeFileMagic starts the header of the store files framed with a version other than 0, followed by the version.
+// Version 0 files have no header, and start with the length of their first record.
+// The magic's first byte has its high bit set, so read as a length it would be far past the end of any store,
+// which tells the two apart.
+var storeFileMagic = []byte{0x89, 'P', 'L', 'G'}
+
+// storeFileHeaderLen is the length of the header of the store files framed with a version other than 0.
+var storeFileHeaderLen = uint64(len(storeFileMagic)) + storeFileVersionNumBytes
+
 // store implements two methods to append and read bytes to and from the file
 type store struct {
 	file *os.File
-	mu   sync.Mutex
+	// mu is only write locked to write to the buffer or the file,
+	// so that reads of records already in the file can happen concurrently.
+	mu   sync.RWMutex
 	buf  *bufio.Writer // we write to buffered writer instead of file to reduce system calls.
 	size uint64        // size is the entire size of the file, ie the length of all records
+	// checksum is whether each record is followed by a checksum of its data.
+	checksum bool
+	// compression is the codec records are compressed with when appended.
+	compression Codec
+	// version is the framing version of the file, which records are appended with.
+	version uint8
+	// start is the position of the first record, after the file's header if any.
+	start uint64
+	// maxRecordBytes bounds the length of the record data read, if nonzero.
+	maxRecordBytes uint64
+	// maxDecodedBytes bounds the length compressed record data is decompressed to, if nonzero.
+	maxDecodedBytes uint64
+	// syncAlways is whether each record is committed to persistent storage when appended.
+	syncAlways bool
+	// stopSync stops the background sync started with SyncInterval, and is nil otherwise.
+	stopSync func()
+	// mmapReads is whether reads are served from mmap.
+	mmapReads bool
+	// mmap maps the start of the file when mmapReads is set. It is nil if nothing is mapped yet.
+	// It is only replaced while s.mu is write locked, so readers can use it while holding the read lock.
+	mmap gommap.MMap
+	// closed is whether Close has closed the file, after which Close does nothing.
+	closed bool
 }
 
 // Append writes the bytes in p into the store.
 // It returns num bytes written (inclusive of record length),
 // the position which we started appending (i.e. the starting byte of the record in the store),
 // and error if any.
+// If writing the record fails, e.g. because the disk is full, the store is left as it was before the append,
+// so that the append can be retried.
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+	return s.appendCompressed(p, s.compression)
+}
+
+// appendCompressed is like Append, but compresses p with compression instead of the store's codec.
+func (s *store) appendCompressed(p []byte, compression Codec) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	pos = s.size // start appending from pos
 
-	// Write the length of the record into the buffer so that
-	// when we read, we know how many bytes to read.
-	// record length is written in big endian encoding.
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
-		return 0, 0, err
+	codec := CodecNone
+	// version 0 can't record the codec, so its records are never compressed.
+	if compression != CodecNone && s.version > 0 {
+		compressed, err := compression.encode(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		// data that doesn't compress is stored as is, which also saves decoding it on read.
+		if len(compressed) < len(p) {
+			p, codec = compressed, compression
+		}
 	}
 
-	// write from p into s.buf
-	numBytesWritten, err := s.buf.Write(p)
-	if err != nil {
+	record := s.frame(p, codec)
+	// the records buffered so far are flushed first if the record doesn't fit in the buffer,
+	// so that the only bytes a failed write can leave behind are the record's own.
+	if len(record) > s.buf.Available() && s.buf.Buffered() > 0 {
+		if err := s.buf.Flush(); err != nil {
+			return 0, 0, err
+		}
+	}
+	rollback := s.buf.Buffered() == 0
+	if err := s.write(record); err != nil {
+		// a failed write leaves the buffer failing every write after it, and some of the record may be in the file.
+		// Both are discarded, unless the buffer holds earlier records, which can't be told apart from the record's bytes.
+		if rollback {
+			s.buf.Reset(s.file)
+			if err := s.truncate(pos); err != nil {
+				return 0, 0, err
+			}
+		}
 		return 0, 0, err
 	}
+	s.size += uint64(len(record))
+	return uint64(len(record)), pos, nil
+}
+
+// frame returns the record made up of p, encoded with codec, framed with the file's version and the store's checksum setting.
+func (s *store) frame(p []byte, codec Codec) []byte {
+	return s.frameVersion(p, codec, s.version)
+}
+
+// frameVersion is like frame, but frames the record with version.
+// Version 0 has no codec, so p must not be encoded.
+func (s *store) frameVersion(p []byte, codec Codec, version uint8) []byte {
+	n := storeRecordLenNumBytes + len(p)
+	if version > 0 {
+		n += storeRecordCodecNumBytes
+	}
+	if s.checksum {
+		n += storeRecordChecksumNumBytes
+	}
 
-	numBytesWritten += storeRecordLenNumBytes
-	s.size += uint64(numBytesWritten)
-	return uint64(numBytesWritten), pos, nil
+	record := make([]byte, n)
+	var i int
+	if version > 0 {
+		record[i] = byte(codec)
+		i += storeRecordCodecNumBytes
+	}
+	// the length of the record data is written so that when we read, we know how many bytes to read.
+	// record length is written in big endian encoding.
+	enc.PutUint64(record[i:], uint64(len(p)))
+	i += storeRecordLenNumBytes
+	i += copy(record[i:], p)
+	if s.checksum {
+		enc.PutUint32(record[i:], crc32.Checksum(p, crcTable))
+	}
+	return record
+}
+
+// write writes the record to the buffer, and commits it to persistent storage if the store syncs every record.
+// The caller must hold s.mu write locked.
+func (s *store) write(record []byte) error {
+	if _, err := s.buf.Write(record); err != nil {
+		return err
+	}
+	if !s.syncAlways {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// rollback removes the records from pos to the end of the store, e.g. the last record,
+// when the index entry for it couldn't be written.
+func (s *store) rollback(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.truncate(pos)
 }
 
 // Read returns the record data stored at the given position given a pos.
 // pos is the byte at which the record starts in the store.
 func (s *store) Read(pos uint64) ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	recordData, _, err := s.ReadWithInfo(pos)
+	return recordData, err
+}
 
+// ReadWithInfo is like Read, but also returns how the record data is stored on disk.
+func (s *store) ReadWithInfo(pos uint64) ([]byte, ReadInfo, error) {
 	// flush the buffer into the underlying writer (the file)
 	// in case where we are trying to read a record that the buffer has not flushed to disk.
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
+	if err := s.rlockFlushed(); err != nil {
+		return nil, ReadInfo{}, err
 	}
+	defer s.mu.RUnlock()
 
-	size := make([]byte, storeRecordLenNumBytes)
-	// read record size from file, where size is a slice of bytes represented in big endian encoding
-	if _, err := s.file.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	// a position past the store, e.g. from a corrupt index entry, gets a clear error rather than the file's.
+	if pos >= s.size || s.size-pos < storeRecordLenNumBytes {
+		return nil, ReadInfo{}, ErrPositionOutOfRange{Pos: pos, StoreSize: s.size}
 	}
-	recordData := make([]byte, enc.Uint64(size))
+	if pos < s.start {
+		return nil, ReadInfo{}, ErrCorruptRecord{Pos: pos}
+	}
+	codec, dataLen, dataPos, err := s.readHeader(pos)
+	if err != nil {
+		return nil, ReadInfo{}, err
+	}
+	// the length is checked before allocating the data, as a corrupt length can be arbitrarily large.
+	if s.maxRecordBytes > 0 && dataLen > s.maxRecordBytes {
+		return nil, ReadInfo{}, ErrCorruptRecord{Pos: pos}
+	}
+	end := dataPos + dataLen
+	if s.checksum {
+		end += storeRecordChecksumNumBytes
+	}
+	// the second condition guards against a length that overflows end.
+	if end > s.size || end < dataPos {
+		return nil, ReadInfo{}, ErrCorruptRecord{Pos: pos}
+	}
+	recordData := make([]byte, dataLen)
 
 	// read record from file into recordData (byte slice)
-	if _, err := s.file.ReadAt(recordData, int64(pos+storeRecordLenNumBytes)); err != nil {
-		return nil, err
+	if _, err := s.readAt(recordData, int64(dataPos)); err != nil {
+		return nil, ReadInfo{}, err
 	}
-	return recordData, nil
+
+	if s.checksum {
+		checksum := make([]byte, storeRecordChecksumNumBytes)
+		checksumPos := dataPos + dataLen
+		if _, err := s.readAt(checksum, int64(checksumPos)); err != nil {
+			return nil, ReadInfo{}, err
+		}
+		if enc.Uint32(checksum) != crc32.Checksum(recordData, crcTable) {
+			return nil, ReadInfo{}, ErrCorruptRecord{Pos: pos}
+		}
+	}
+
+	info := ReadInfo{
+		CompressedBytes: dataLen,
+		Codec:           codec,
+	}
+	if codec != CodecNone {
+		recordData, err = codec.decode(recordData, s.maxDecodedBytes)
+		if err == errDecodedTooLarge {
+			return nil, ReadInfo{}, ErrCorruptRecord{Pos: pos}
+		}
+		if err != nil {
+			return nil, ReadInfo{}, err
+		}
+	}
+	info.UncompressedBytes = uint64(len(recordData))
+	return recordData, info, nil
+}
+
+// readNext returns the record data at pos along with the position of the following record,
+// or io.EOF if pos is at the end of the store.
+func (s *store) readNext(pos uint64) ([]byte, uint64, error) {
+	if err := s.rlockFlushed(); err != nil {
+		return nil, 0, err
+	}
+	if pos >= s.size {
+		s.mu.RUnlock()
+		return nil, 0, io.EOF
+	}
+	end, err := s.recordEnd(pos)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := s.Read(pos)
+	return data, end, err
 }
 
 // ReadAt reads len(p) bytes into p starting from the given pos in the store's file.
 // It returns the number of bytes n read into p, if n < len(p), an error will be returned.
 // It implements io.ReaderAt.
 func (s *store) ReadAt(p []byte, pos int64) (int, error) {
+	if err := s.rlockFlushed(); err != nil {
+		return 0, err
+	}
+	defer s.mu.RUnlock()
+	return s.readAt(p, pos)
+}
+
+// readAt is like ReadAt, but serves p from the memory map if it is mapped.
+// The caller must hold s.mu (read or write locked) and have flushed the buffer.
+func (s *store) readAt(p []byte, pos int64) (int, error) {
+	if end := pos + int64(len(p)); pos >= 0 && end <= int64(len(s.mmap)) {
+		return copy(p, s.mmap[pos:end]), nil
+	}
+	return s.file.ReadAt(p, pos)
+}
+
+// remap maps the whole file when mmapReads is set and the file has changed size since it was mapped.
+// The caller must hold s.mu write locked and have flushed the buffer.
+func (s *store) remap() error {
+	if !s.mmapReads || uint64(len(s.mmap)) == s.size {
+		return nil
+	}
+	if s.mmap != nil {
+		if err := s.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
+	// an empty file can't be mapped.
+	if s.size == 0 {
+		return nil
+	}
+	m, err := gommap.MapRegion(s.file.Fd(), 0, int64(s.size), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap = m
+	return nil
+}
+
+// rlockFlushed read locks s.mu once the buffer is flushed, so that every record appended so far can be read from the file,
+// and once the memory map, if any, covers the whole file.
+// The write lock is only taken if the buffer holds data or the map is stale,
+// so reads of a flushed, mapped store don't wait on each other.
+// The caller must read unlock s.mu if it returns nil.
+func (s *store) rlockFlushed() error {
+	s.mu.RLock()
+	if s.buf.Buffered() == 0 && !s.mmapStale() {
+		return nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	err := s.buf.Flush()
+	if err == nil {
+		err = s.remap()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// records appended in between the locks are left in the buffer, which is fine,
+	// as they were appended after the read started.
+	s.mu.RLock()
+	return nil
+}
+
+// mmapStale returns whether the file has grown past the memory map, when mmapReads is set.
+// The caller must hold s.mu (read or write locked) and have flushed the buffer.
+func (s *store) mmapStale() bool {
+	return s.mmapReads && uint64(len(s.mmap)) != s.size
+}
+
+// truncateTornTail scans the records from pos to the end of the store,
+// and truncates the store at the start of the first incomplete record, if any.
+// It returns the number of bytes truncated.
+func (s *store) truncateTornTail(pos uint64) (uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
 		return 0, err
 	}
-	return s.file.ReadAt(p, pos)
+
+	for pos < s.size {
+		end, err := s.recordEnd(pos)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		pos = end
+	}
+	if pos >= s.size {
+		return 0, nil
+	}
+
+	torn := s.size - pos
+	return torn, s.truncate(pos)
+}
+
+// truncate truncates the store's file at pos, removing the bytes from pos on.
+// The caller must hold s.mu write locked, and have flushed or discarded the buffer.
+func (s *store) truncate(pos uint64) error {
+	// the map must not cover the truncated bytes, as reading past the end of the file through it faults.
+	if s.mmap != nil {
+		if err := s.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
+	if err := s.file.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	return s.remap()
+}
+
+// recordEnd returns the position right after the record starting at pos,
+// or io.ErrUnexpectedEOF if the record is incomplete.
+// The caller must hold s.mu (read or write locked) and have flushed the buffer.
+func (s *store) recordEnd(pos uint64) (uint64, error) {
+	_, dataLen, dataPos, err := s.readHeader(pos)
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	end := dataPos + dataLen
+	if s.checksum {
+		end += storeRecordChecksumNumBytes
+	}
+	// the second condition guards against a length that overflows end.
+	if end > s.size || end < pos {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return end, nil
+}
+
+// readHeader reads the header of the record starting at pos,
+// which is made up of the codec of the record data, the length of the data, and the position the data starts at.
+// A version 0 record starts with the length, and its data is never encoded.
+// A version 1 record starts with a byte holding the codec, followed by the length.
+// It returns io.EOF if pos is at the end of the store, and io.ErrUnexpectedEOF if the header is incomplete.
+// The caller must hold s.mu (read or write locked) and have flushed the buffer.
+func (s *store) readHeader(pos uint64) (codec Codec, dataLen uint64, dataPos uint64, err error) {
+	if pos >= s.size {
+		return 0, 0, 0, io.EOF
+	}
+	headerLen := storeRecordLenNumBytes
+	if s.version > 0 {
+		headerLen += storeRecordCodecNumBytes
+	}
+	header := make([]byte, headerLen)
+	n, err := s.readAt(header, int64(pos))
+	if err != nil && err != io.EOF {
+		return 0, 0, 0, err
+	}
+	if n < headerLen {
+		return 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	if s.version == 0 {
+		return CodecNone, enc.Uint64(header), pos + storeRecordLenNumBytes, nil
+	}
+
+	codec = Codec(header[0])
+	if !codec.valid() {
+		return 0, 0, 0, ErrCorruptRecord{Pos: pos}
+	}
+	dataPos = pos + storeRecordCodecNumBytes + storeRecordLenNumBytes
+	return codec, enc.Uint64(header[storeRecordCodecNumBytes:]), dataPos, nil
+}
+
+// Flush writes any buffered data to the underlying file.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Sync writes any buffered data to the underlying file and commits the file to persistent storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// syncEvery syncs the store every interval until done is closed.
+func (s *store) syncEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// a failed sync is retried on the next tick, and surfaces when the store is closed.
+			_ = s.Sync()
+		}
+	}
 }
 
 // Close persists any data before closing the file.
 func (s *store) Close() error {
+	if s.stopSync != nil {
+		s.stopSync()
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
-	return s.file.Close()
+	if s.mmap != nil {
+		if err := s.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.closed = true
+	return nil
 }
 
 func (s *store) Name() string {
 	return s.file.Name()
 }
 
-func newStore(f *os.File) (*store, error) {
+// initHeader reads the version of the store's file from its header, if any.
+// An empty file is given the header of version, unless version is 0 or readOnly is set.
+// A file left with an incomplete header, by a crash right after it was created, is treated as empty.
+func (s *store) initHeader(version uint8, readOnly bool) error {
+	header := make([]byte, storeFileHeaderLen)
+	n, err := s.file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	header = header[:n]
+	magicLen := len(storeFileMagic)
+	switch {
+	case n == 0:
+	case n >= magicLen && bytes.Equal(header[:magicLen], storeFileMagic):
+		if uint64(n) < storeFileHeaderLen {
+			break
+		}
+		s.version, s.start = header[magicLen], storeFileHeaderLen
+		if s.version == 0 || s.version > FormatVersion {
+			return fmt.Errorf("store %s has format version %d, which is not supported", s.Name(), s.version)
+		}
+		return nil
+	case n < magicLen && bytes.HasPrefix(storeFileMagic, header):
+	default:
+		// the file starts with the length of a version 0 record.
+		return nil
+	}
+
+	if readOnly {
+		if n > 0 {
+			return fmt.Errorf("store %s has an incomplete header", s.Name())
+		}
+		return nil
+	}
+	if n > 0 {
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+		// files not opened for appending would be written at the end of the bytes truncated.
+		if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		s.size = 0
+	}
+	if version == 0 {
+		return nil
+	}
+	header = append(append([]byte{}, storeFileMagic...), version)
+	if _, err := s.buf.Write(header); err != nil {
+		return err
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	s.version, s.start, s.size = version, storeFileHeaderLen, storeFileHeaderLen
+	return nil
+}
+
+func newStore(f *os.File, c Config) (*store, error) {
 	// get file's current size, in case the file already contains data
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(fi.Size())
-	return &store{
-		file: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+	buf := bufio.NewWriter(f)
+	if c.Store.WriteBufferSize > 0 {
+		buf = bufio.NewWriterSize(f, c.Store.WriteBufferSize)
+	}
+	s := &store{
+		file:            f,
+		size:            size,
+		buf:             buf,
+		checksum:        c.Store.ChecksumEnabled,
+		compression:     c.Store.Compression,
+		maxRecordBytes:  c.Store.MaxRecordBytes,
+		maxDecodedBytes: c.Segment.MaxRecordBytes,
+		syncAlways:      c.Store.SyncPolicy == SyncAlways,
+		mmapReads:       c.Store.MmapReads,
+	}
+	if s.maxDecodedBytes == 0 {
+		s.maxDecodedBytes = c.Store.MaxRecordBytes
+	}
+	// version 0 can't record the codec, so compressed stores are created with version 1 at least.
+	version := c.Store.FormatVersion
+	if version == 0 && c.Store.Compression != CodecNone {
+		version = 1
+	}
+	if err := s.initHeader(version, c.ReadOnly); err != nil {
+		return nil, err
+	}
+	if err := s.remap(); err != nil {
+		return nil, err
+	}
+	if c.Store.SyncPolicy == SyncInterval {
+		interval := c.Store.SyncInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s.syncEvery(interval, done)
+		}()
+		var once sync.Once
+		s.stopSync = func() {
+			once.Do(func() { close(done) })
+			<-stopped
+		}
+	}
+	return s, nil
 }
@@ -1,9 +1,15 @@
 package log
 
 import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
 	"io/ioutil"
+	mathrand "math/rand"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -19,7 +25,7 @@ func TestStoreAppendRead(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 
 	testAppend(t, s)
@@ -27,7 +33,7 @@ func TestStoreAppendRead(t *testing.T) {
 	testReadAt(t, s)
 
 	// test that our service (store implementation) resumes reading from the latest record on service failure
-	s, err = newStore(f)
+	s, err = newStore(f, Config{})
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -80,7 +86,7 @@ func TestStoreClose(t *testing.T) {
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(f, Config{})
 	require.NoError(t, err)
 
 	_, _, err = s.Append(recordData)
@@ -115,3 +121,571 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.ChecksumEnabled = true
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+
+	checksumRecordLen := recordLen + storeRecordChecksumNumBytes
+	for i := uint64(1); i < 4; i++ {
+		n, pos, err := s.Append(recordData)
+		require.NoError(t, err)
+		require.Equal(t, checksumRecordLen*i, pos+n)
+	}
+	var pos uint64
+	for i := uint64(1); i < 4; i++ {
+		rd, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, recordData, rd)
+		pos += checksumRecordLen
+	}
+	require.NoError(t, s.Close())
+
+	// flip a byte in the data of the second record.
+	corrupt, err := os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	corruptPos := int64(checksumRecordLen + storeRecordLenNumBytes)
+	b := make([]byte, 1)
+	_, err = corrupt.ReadAt(b, corruptPos)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = corrupt.WriteAt(b, corruptPos)
+	require.NoError(t, err)
+	require.NoError(t, corrupt.Close())
+
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+
+	_, err = s.Read(0)
+	require.NoError(t, err)
+	_, err = s.Read(checksumRecordLen)
+	require.Equal(t, ErrCorruptRecord{Pos: checksumRecordLen}, err)
+}
+
+func TestStoreCompression(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_compression_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.Compression = CodecGzip
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+
+	compressible := bytes.Repeat([]byte("hello world "), 100)
+	incompressible := make([]byte, 1024)
+	_, err = rand.Read(incompressible)
+	require.NoError(t, err)
+
+	n, compressiblePos, err := s.Append(compressible)
+	require.NoError(t, err)
+	require.True(t, n < uint64(len(compressible)))
+
+	n, incompressiblePos, err := s.Append(incompressible)
+	require.NoError(t, err)
+	// incompressible data is stored as is.
+	require.Equal(t, uint64(len(incompressible))+storeRecordCodecNumBytes+storeRecordLenNumBytes, n)
+
+	rd, info, err := s.ReadWithInfo(compressiblePos)
+	require.NoError(t, err)
+	require.Equal(t, compressible, rd)
+	require.Equal(t, CodecGzip, info.Codec)
+	require.Equal(t, uint64(len(compressible)), info.UncompressedBytes)
+	require.Equal(t, incompressiblePos-compressiblePos-storeRecordCodecNumBytes-storeRecordLenNumBytes, info.CompressedBytes)
+
+	rd, info, err = s.ReadWithInfo(incompressiblePos)
+	require.NoError(t, err)
+	require.Equal(t, incompressible, rd)
+	require.Equal(t, ReadInfo{
+		CompressedBytes:   uint64(len(incompressible)),
+		UncompressedBytes: uint64(len(incompressible)),
+		Codec:             CodecNone,
+	}, info)
+	require.NoError(t, s.Close())
+
+	// the codec is recorded with each record, so the store reads the same without compression configured.
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	s, err = newStore(f, Config{})
+	require.NoError(t, err)
+	rd, err = s.Read(compressiblePos)
+	require.NoError(t, err)
+	require.Equal(t, compressible, rd)
+	rd, err = s.Read(incompressiblePos)
+	require.NoError(t, err)
+	require.Equal(t, incompressible, rd)
+}
+
+func TestStoreReadOutOfRange(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_out_of_range_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	testAppend(t, s)
+	size := recordLen * 3
+
+	for _, pos := range []uint64{size, size + 1, size - storeRecordLenNumBytes + 1, 1 << 62} {
+		_, err = s.Read(pos)
+		require.Equal(t, ErrPositionOutOfRange{Pos: pos, StoreSize: size}, err)
+	}
+
+	// a bogus length is rejected before the data is allocated.
+	require.NoError(t, s.Flush())
+	w, err := os.OpenFile(f.Name(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	bogus := make([]byte, storeRecordLenNumBytes)
+	enc.PutUint64(bogus, 1<<55)
+	_, err = w.WriteAt(bogus, int64(recordLen))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, err = s.Read(recordLen)
+	require.Equal(t, ErrCorruptRecord{Pos: recordLen}, err)
+}
+
+func TestStoreMaxRecordBytes(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_max_record_bytes_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.MaxRecordBytes = uint64(len(recordData))
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+	testAppend(t, s)
+	testRead(t, s)
+
+	// a corrupt length that is within the store, but larger than any record, is rejected before the data is allocated.
+	require.NoError(t, s.Flush())
+	w, err := os.OpenFile(f.Name(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	bogus := make([]byte, storeRecordLenNumBytes)
+	enc.PutUint64(bogus, recordLen*2)
+	_, err = w.WriteAt(bogus, 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	_, err = s.Read(0)
+	require.Equal(t, ErrCorruptRecord{Pos: 0}, err)
+}
+
+func TestStoreMixedCodecs(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_mixed_codecs_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	compressible := bytes.Repeat([]byte("hello world "), 100)
+	positions := make(map[Codec]uint64)
+	// each codec appends a record to the same store, as if the log were reopened with a different codec each time.
+	for _, codec := range []Codec{CodecGzip, CodecSnappy, CodecNone} {
+		c := Config{}
+		c.Store.Compression = codec
+		s, err := newStore(f, c)
+		require.NoError(t, err)
+		n, pos, err := s.Append(compressible)
+		require.NoError(t, err)
+		if codec != CodecNone {
+			require.True(t, n < uint64(len(compressible)))
+		}
+		positions[codec] = pos
+		require.NoError(t, s.Close())
+		f, _, err = openFile(f.Name())
+		require.NoError(t, err)
+	}
+
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	defer s.Close()
+	for codec, pos := range positions {
+		rd, info, err := s.ReadWithInfo(pos)
+		require.NoError(t, err)
+		require.Equal(t, compressible, rd)
+		require.Equal(t, codec, info.Codec)
+	}
+}
+
+func TestStoreFormatVersion(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_format_version_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// a version 0 store, as written before stores were versioned: each record's length followed by its data.
+	v0 := make([]byte, storeRecordLenNumBytes, recordLen)
+	enc.PutUint64(v0, uint64(len(recordData)))
+	v0 = append(v0, recordData...)
+	_, err = f.Write(v0)
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Store.FormatVersion = 1
+	c.Store.Compression = CodecGzip
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	// the store keeps its version, so its records are still framed the same, and can't be compressed.
+	require.Equal(t, uint8(0), s.version)
+	compressible := bytes.Repeat([]byte("hello world "), 100)
+	n, pos, err := s.Append(compressible)
+	require.NoError(t, err)
+	require.Equal(t, recordLen, pos)
+	require.Equal(t, uint64(len(compressible))+storeRecordLenNumBytes, n)
+	testReadBack(t, s, map[uint64][]byte{0: recordData, pos: compressible})
+	require.NoError(t, s.Close())
+
+	// a new store is created with the version, recorded in the file's header.
+	f, err = ioutil.TempFile("", "store_format_version_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	n, v1Pos, err := s.Append(recordData)
+	require.NoError(t, err)
+	require.Equal(t, storeFileHeaderLen, v1Pos)
+	// data that doesn't compress is still preceded by the codec.
+	require.Equal(t, recordLen+storeRecordCodecNumBytes, n)
+	_, compressedPos, err := s.Append(compressible)
+	require.NoError(t, err)
+
+	header := make([]byte, storeFileHeaderLen+storeRecordCodecNumBytes)
+	_, err = s.ReadAt(header, 0)
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte{}, storeFileMagic...), 1, byte(CodecNone)), header)
+	require.NoError(t, s.Close())
+
+	// the version is recorded in the file, so the store reads the same without a version configured.
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	s, err = newStore(f, Config{})
+	require.NoError(t, err)
+	require.Equal(t, uint8(1), s.version)
+	testReadBack(t, s, map[uint64][]byte{v1Pos: recordData, compressedPos: compressible})
+	torn, err := s.truncateTornTail(s.start)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), torn)
+	// a position within the header is not a record.
+	_, err = s.Read(0)
+	require.Equal(t, ErrCorruptRecord{Pos: 0}, err)
+	require.NoError(t, s.Close())
+
+	// a file with a version newer than the package's can't be opened.
+	f, err = ioutil.TempFile("", "store_format_version_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(append(append([]byte{}, storeFileMagic...), FormatVersion+1))
+	require.NoError(t, err)
+	_, err = newStore(f, Config{})
+	require.Error(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestStoreTornFileHeader(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_torn_file_header_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// a crash right after the file was created can leave part of its header.
+	_, err = f.Write(storeFileMagic[:2])
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Store.FormatVersion = 1
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint8(1), s.version)
+	require.Equal(t, storeFileHeaderLen, s.size)
+	_, pos, err := s.Append(recordData)
+	require.NoError(t, err)
+	testReadBack(t, s, map[uint64][]byte{pos: recordData})
+}
+
+func TestStoreMaxDecodedBytes(t *testing.T) {
+	compressible := bytes.Repeat([]byte("hello world "), 100)
+	for _, codec := range []Codec{CodecGzip, CodecSnappy} {
+		t.Run(codec.String(), func(t *testing.T) {
+			f, err := ioutil.TempFile("", "store_max_decoded_bytes_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Store.Compression = codec
+			s, err := newStore(f, c)
+			require.NoError(t, err)
+			_, pos, err := s.Append(compressible)
+			require.NoError(t, err)
+			require.NoError(t, s.Close())
+
+			// the record decompresses to more than the records the store is opened for.
+			f, _, err = openFile(f.Name())
+			require.NoError(t, err)
+			c.Segment.MaxRecordBytes = uint64(len(compressible)) - 1
+			s, err = newStore(f, c)
+			require.NoError(t, err)
+			defer s.Close()
+			_, err = s.Read(pos)
+			require.Equal(t, ErrCorruptRecord{Pos: pos}, err)
+		})
+	}
+}
+
+// testReadBack reads the records at the positions of want, and checks their data.
+func testReadBack(t *testing.T, s *store, want map[uint64][]byte) {
+	t.Helper()
+	for pos, data := range want {
+		rd, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, data, rd)
+	}
+}
+
+func TestStoreSyncPolicy(t *testing.T) {
+	for scenario, policy := range map[string]SyncPolicy{
+		"always":   SyncAlways,
+		"interval": SyncInterval,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "store_sync_policy_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Store.SyncPolicy = policy
+			c.Store.SyncInterval = 10 * time.Millisecond
+			s, err := newStore(f, c)
+			require.NoError(t, err)
+			defer s.Close()
+
+			_, _, err = s.Append(recordData)
+			require.NoError(t, err)
+
+			flushed := func() bool {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return s.buf.Buffered() == 0
+			}
+			if policy == SyncAlways {
+				require.True(t, flushed())
+			} else {
+				require.Eventually(t, flushed, time.Second, c.Store.SyncInterval)
+			}
+			fi, err := os.Stat(f.Name())
+			require.NoError(t, err)
+			require.Equal(t, int64(recordLen), fi.Size())
+		})
+	}
+}
+
+func TestStoreMmapReads(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_mmap_reads_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Store.MmapReads = true
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	require.Nil(t, s.mmap)
+
+	testAppend(t, s)
+	testRead(t, s)
+	testReadAt(t, s)
+	require.Equal(t, 3*recordLen, uint64(len(s.mmap)))
+
+	// the map is extended to read records appended after it was made.
+	_, pos, err := s.Append([]byte("grown"))
+	require.NoError(t, err)
+	rd, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, []byte("grown"), rd)
+	require.Equal(t, s.size, uint64(len(s.mmap)))
+	require.NoError(t, s.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, s.size, uint64(len(s.mmap)))
+	testRead(t, s)
+}
+
+// countingWriter counts the writes made to w.
+type countingWriter struct {
+	w      io.Writer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.w.Write(p)
+}
+
+// countFileWrites makes s's buffer write to s's file through a countingWriter, keeping the buffer's size,
+// and returns the countingWriter.
+func countFileWrites(t testing.TB, s *store) *countingWriter {
+	// the buffer is flushed first, as resetting it drops what it holds, e.g. the file header.
+	require.NoError(t, s.Flush())
+	w := &countingWriter{w: s.file}
+	s.buf.Reset(w)
+	return w
+}
+
+func TestStoreWriteBufferSize(t *testing.T) {
+	record := bytes.Repeat([]byte("a"), 16*1024)
+	const records = 64
+	writes := make(map[int]int)
+	for _, size := range []int{0, 64 * 1024, 1024 * 1024} {
+		f, err := ioutil.TempFile("", "store_write_buffer_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		c := Config{}
+		c.Store.WriteBufferSize = size
+		s, err := newStore(f, c)
+		require.NoError(t, err)
+		w := countFileWrites(t, s)
+		var pos uint64
+		for i := 0; i < records; i++ {
+			_, pos, err = s.Append(record)
+			require.NoError(t, err)
+		}
+		require.NoError(t, s.Flush())
+		writes[size] = w.writes
+
+		// the records are written as they are, however they are buffered.
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, record, read)
+		require.NoError(t, s.Close())
+	}
+	// the default buffer is smaller than a record, so records are written one or more writes each,
+	// while larger buffers gather several records per write.
+	require.GreaterOrEqual(t, writes[0], records)
+	require.Less(t, writes[64*1024], writes[0])
+	require.Less(t, writes[1024*1024], writes[64*1024])
+}
+
+// BenchmarkStoreAppend reports the writes the store makes to its file per appended record, as writes/op,
+// which a write buffer larger than the records reduces.
+func BenchmarkStoreAppend(b *testing.B) {
+	record := bytes.Repeat([]byte("a"), 16*1024)
+	for _, size := range []int{0, 64 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("write buffer size %d", size), func(b *testing.B) {
+			f, err := ioutil.TempFile("", "store_append_benchmark")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Store.WriteBufferSize = size
+			s, err := newStore(f, c)
+			require.NoError(b, err)
+			defer s.Close()
+			w := countFileWrites(b, s)
+
+			b.SetBytes(int64(len(record)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.Append(record); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	// a representative payload: a marshalled record holding a JSON event.
+	var payload []byte
+	for i := 0; len(payload) < 4096; i++ {
+		payload = append(payload, fmt.Sprintf(`{"id":%d,"user":"user-%d","event":"page_view","path":"/products/%d"},`, i, i%97, i%13)...)
+	}
+	for _, codec := range []Codec{CodecGzip, CodecSnappy} {
+		b.Run(codec.String(), func(b *testing.B) {
+			var compressed []byte
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				var err error
+				if compressed, err = codec.encode(payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.decode(compressed, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(payload))/float64(len(compressed)), "ratio")
+		})
+	}
+}
+
+func BenchmarkStoreReadParallel(b *testing.B) {
+	f, err := ioutil.TempFile("", "store_read_benchmark")
+	require.NoError(b, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, Config{})
+	require.NoError(b, err)
+	defer s.Close()
+
+	const records = 1024
+	for i := 0; i < records; i++ {
+		_, _, err := s.Append(recordData)
+		require.NoError(b, err)
+	}
+
+	b.SetBytes(int64(len(recordData)))
+	b.ResetTimer()
+	// reads of a flushed store only take the read lock, so they don't wait on each other.
+	b.RunParallel(func(pb *testing.PB) {
+		var i uint64
+		for pb.Next() {
+			if _, err := s.Read((i % records) * recordLen); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkStoreRandomRead(b *testing.B) {
+	for name, mmapReads := range map[string]bool{
+		"read at": false,
+		"mmap":    true,
+	} {
+		b.Run(name, func(b *testing.B) {
+			f, err := ioutil.TempFile("", "store_random_read_benchmark")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+
+			c := Config{}
+			c.Store.MmapReads = mmapReads
+			s, err := newStore(f, c)
+			require.NoError(b, err)
+			defer s.Close()
+
+			const records = 1024
+			for i := 0; i < records; i++ {
+				_, _, err := s.Append(recordData)
+				require.NoError(b, err)
+			}
+
+			rnd := mathrand.New(mathrand.NewSource(1))
+			b.SetBytes(int64(len(recordData)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Read(uint64(rnd.Intn(records)) * recordLen); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package log
+
+import (
+	"sort"
+	"time"
+)
+
+// timeIndex maps record timestamps to the records' offsets, so that records can be looked up by time.
+// It has the same layout as index, except that each entry's position holds a timestamp in Unix nanoseconds.
+// An entry is only written for a record whose timestamp is later than every previous record's in the segment,
+// so the entries are in increasing order of both offset and timestamp even if the records' timestamps are not.
+type timeIndex struct {
+	*index
+}
+
+// Write adds an entry for the record with relative offset off and timestamp t,
+// unless a previous record's timestamp is at least as late.
+func (i *timeIndex) Write(off uint64, t time.Time) error {
+	nanos := uint64(t.UnixNano())
+	if n := i.entries(); n > 0 && i.entryTime(n-1) >= nanos {
+		return nil
+	}
+	return i.index.Write(off, nanos)
+}
+
+// Lookup returns the absolute offset of the first record with a timestamp at or after t,
+// and whether there is one.
+func (i *timeIndex) Lookup(t time.Time) (uint64, bool) {
+	nanos := uint64(t.UnixNano())
+	n := sort.Search(i.entries(), func(n int) bool {
+		return i.entryTime(n) >= nanos
+	})
+	if n == i.entries() {
+		return 0, false
+	}
+	return i.entryOffset(n), true
+}
+
+// entryTime returns the timestamp, in Unix nanoseconds, of the n-th entry (starting from 0).
+func (i *timeIndex) entryTime(n int) uint64 {
+	return i.entryPos(n)
+}
@@ -0,0 +1,123 @@
+package log
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// UsageBucket is the number of store bytes holding records from a period of time.
+type UsageBucket struct {
+	// Start is the start of the bucket's period, which lasts for the bucket size.
+	Start time.Time
+	Bytes uint64
+}
+
+// DiskUsageByTime returns how the log's store bytes are distributed over time,
+// in buckets of the given size ordered from oldest to newest. Empty buckets are omitted.
+// The distribution is approximated at segment granularity:
+// all of a segment's bytes are attributed to the bucket of its newest record.
+// Segments whose newest record has no timestamp are attributed by their store file's modification time.
+// Up to Config.MaxVerifyConcurrency segments are read at once.
+// Segments removed while they are read, e.g. by Truncate, are left out.
+func (l *Log) DiskUsageByTime(bucket time.Duration) ([]UsageBucket, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("bucket size must be positive: %s", bucket)
+	}
+
+	segments, active, err := l.segmentsSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	// sizes is left zero for the segments without records, and for those removed before they are read.
+	newest := make([]time.Time, len(segments))
+	sizes := make([]uint64, len(segments))
+	errs := make([]error, len(segments))
+	l.scanSegments(segments, active, func(i int, s *segment) {
+		// a segment can have offsets without records, e.g. skipped ones, so its records are told by its index.
+		if _, ok := s.lastOffset(); ok {
+			newest[i], errs[i] = s.newestTime()
+			sizes[i] = s.store.size
+		}
+	})
+
+	usage := make(map[time.Time]uint64)
+	for i := range segments {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if sizes[i] == 0 {
+			continue
+		}
+		usage[newest[i].Truncate(bucket)] += sizes[i]
+	}
+
+	buckets := make([]UsageBucket, 0, len(usage))
+	for start, bytes := range usage {
+		buckets = append(buckets, UsageBucket{Start: start, Bytes: bytes})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets, nil
+}
+
+// LogStats describes the log's segments and the disk space they use.
+type LogStats struct {
+	Segments int
+	// StoreBytes and IndexBytes are the bytes of records and index entries written across all segments.
+	StoreBytes uint64
+	IndexBytes uint64
+	// LowestOffset and HighestOffset are as returned by Log.LowestOffset and Log.HighestOffset.
+	// HighestOffset is 0 when the log is empty.
+	LowestOffset  uint64
+	HighestOffset uint64
+	// ActiveBaseOffset is the base offset of the segment being appended to.
+	ActiveBaseOffset uint64
+}
+
+// SegmentInfo describes a segment's offsets and the disk space it uses.
+type SegmentInfo struct {
+	BaseOffset uint64
+	// NextOffset is the offset the segment's next record would be assigned.
+	NextOffset uint64
+	// StoreBytes and IndexBytes are the bytes of records and index entries written to the segment.
+	StoreBytes uint64
+	IndexBytes uint64
+}
+
+// info returns the segment's SegmentInfo.
+func (s *segment) info() SegmentInfo {
+	return SegmentInfo{
+		BaseOffset: s.baseOffset,
+		NextOffset: s.nextOffset,
+		StoreBytes: s.store.size,
+		IndexBytes: s.index.size,
+	}
+}
+
+// Stats returns the log's segment count, disk usage, and offsets, as of a single point in time.
+// It only sums the sizes the log keeps in memory, without reading the segments, so it needn't scan them in parallel.
+// A closed log, or one without segments, e.g. after Truncate removed them all, has no stats, i.e. they are all zero.
+func (l *Log) Stats() LogStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed || len(l.segments) == 0 {
+		return LogStats{}
+	}
+
+	stats := LogStats{
+		Segments:         len(l.segments),
+		LowestOffset:     l.segments[0].baseOffset,
+		ActiveBaseOffset: l.activeSegment.baseOffset,
+	}
+	if highest, ok := l.highestOffset(); ok {
+		stats.HighestOffset = highest
+	}
+	for _, s := range l.segments {
+		stats.StoreBytes += s.store.size
+		stats.IndexBytes += s.index.size
+	}
+	return stats
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// VerifyError describes a problem Verify found with a record.
+type VerifyError struct {
+	// BaseOffset is the base offset of the segment holding the record.
+	BaseOffset uint64
+	// Offset is the offset of the record, as recorded in its index entry.
+	Offset uint64
+	// Pos is the position of the record in the store, as recorded in its index entry.
+	Pos uint64
+	Err error
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("segment %d: offset %d at position %d: %v", e.BaseOffset, e.Offset, e.Pos, e.Err)
+}
+
+// Verify checks the integrity of every record in the log, by reading each record through its index entry.
+// This checks that the entry points into the store at the record with its offset,
+// and, if checksums are enabled, that the record's data matches its checksum.
+// Rather than stopping at the first problem, it returns every problem found, ordered by offset,
+// and only returns an error if the log could not be verified.
+// Up to Config.MaxVerifyConcurrency segments are verified at once.
+// Segments removed while the log is verified, e.g. by Truncate, are left out.
+func (l *Log) Verify() ([]VerifyError, error) {
+	segments, active, err := l.segmentsSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	segmentProblems := make([][]VerifyError, len(segments))
+	l.scanSegments(segments, active, func(i int, s *segment) {
+		segmentProblems[i] = s.verify()
+	})
+	var problems []VerifyError
+	for _, p := range segmentProblems {
+		problems = append(problems, p...)
+	}
+	return problems, nil
+}
+
+// segmentsSnapshot returns a copy of the log's segments and its active segment, for scanSegments.
+func (l *Log) segmentsSnapshot() (segments []*segment, active *segment, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	return append([]*segment(nil), l.segments...), l.activeSegment, nil
+}
+
+// scanSegments calls fn with each of segments, as returned by segmentsSnapshot, and its index in segments,
+// running up to Config.MaxVerifyConcurrency calls at once, and returns once every call has returned.
+// The log's lock isn't held while the other segments are scanned, as only the active segment is appended to,
+// so that a long scan doesn't hold up appends. Instead, closing a segment waits for its scan to finish,
+// and a segment closed before it is scanned, e.g. because Truncate removed it, is skipped.
+// fn must only read the segment, which is safe concurrently with reading other segments.
+func (l *Log) scanSegments(segments []*segment, active *segment, fn func(i int, s *segment)) {
+	workers := l.Config.MaxVerifyConcurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(segments) {
+		workers = len(segments)
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				s := segments[i]
+				if s == active {
+					l.scanActive(s, func() { fn(i, s) })
+					continue
+				}
+				if !s.pin() {
+					continue
+				}
+				fn(i, s)
+				s.unpin()
+			}
+		}()
+	}
+	for i := range segments {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// scanActive calls fn under the read lock, as s was the active segment, unless s is closed.
+// Segments are only closed under the write lock, so s can't be closed while fn runs.
+func (l *Log) scanActive(s *segment, fn func()) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	fn()
+}
+
+// verify checks the integrity of every record in the segment, see Log.Verify.
+func (s *segment) verify() []VerifyError {
+	var problems []VerifyError
+	for i := uint64(0); i < s.index.size/indexEntryWidth; i++ {
+		out, pos, err := s.index.Read(int64(i))
+		off := s.baseOffset + uint64(out)
+		// reading a position past the store fails with ErrPositionOutOfRange.
+		if err == nil {
+			_, _, err = s.readAt(off, pos)
+		}
+		if err != nil {
+			problems = append(problems, VerifyError{
+				BaseOffset: s.baseOffset,
+				Offset:     off,
+				Pos:        pos,
+				Err:        err,
+			})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	api "github.com/jxofficial/proglog/api/v1"
+	"github.com/jxofficial/proglog/internal/log"
+)
+
+// produceStreamFlushInterval is the default Config.ProduceStreamFlushInterval.
+const produceStreamFlushInterval = 10 * time.Millisecond
+
+// received is a request received on a produce stream, or the error that ended the stream.
+type received struct {
+	req *api.ProduceRequest
+	err error
+}
+
+// produceStreamBatched appends the records received on the stream in batches of up to ProduceStreamBatchSize,
+// appending a partial batch once ProduceStreamFlushInterval has passed since its first record was received,
+// or once the client closes the stream. The records are appended, and their offsets sent, in the order received.
+// A record with a dedup key or a topic is produced on its own, after the records received before it.
+func (s *grpcServer) produceStreamBatched(stream api.Log_ProduceStreamServer, clog batchAppender) error {
+	ctx := stream.Context()
+	interval := s.ProduceStreamFlushInterval
+	if interval <= 0 {
+		interval = produceStreamFlushInterval
+	}
+
+	// requests are received in the background, so that a batch can be appended once the interval passes
+	// even while waiting for the next request.
+	requests := make(chan received, s.ProduceStreamBatchSize)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case requests <- received{req: req, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	batch := make([]*api.Record, 0, s.ProduceStreamBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		defer func() { batch = batch[:0] }()
+		release, err := s.acquireAppend()
+		if err != nil {
+			return err
+		}
+		infos, err := appendBatch(clog, batch)
+		release()
+		// the offsets of the records appended before a failure are still sent.
+		for _, info := range infos {
+			resp := &api.ProduceResponse{
+				Offset:     info.Offset,
+				Position:   info.Position,
+				BaseOffset: info.BaseOffset,
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+
+	var timeout <-chan time.Time
+	for {
+		select {
+		case <-timeout:
+			timeout = nil
+			if err := flush(); err != nil {
+				return err
+			}
+		case r := <-requests:
+			if r.err == io.EOF {
+				return flush()
+			}
+			if r.err != nil {
+				return r.err
+			}
+			if err := s.prepareProduce(r.req.Record, r.req.Codec); err != nil {
+				return err
+			}
+			// batches are appended to CommitLog, so records for other topics are routed by produceRequest,
+			// without authorizing them again.
+			if (s.dedup != nil && r.req.DedupKey != "") || r.req.Topic != "" {
+				timeout = nil
+				if err := flush(); err != nil {
+					return err
+				}
+				resp, err := s.produceRequest(ctx, r.req)
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(resp); err != nil {
+					return err
+				}
+				continue
+			}
+			batch = append(batch, r.req.Record)
+			if len(batch) == 1 {
+				timeout = time.After(interval)
+			}
+			if len(batch) == s.ProduceStreamBatchSize {
+				timeout = nil
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// appendBatch appends the records to clog, and returns where they were stored,
+// like Produce, if clog can tell, or else only their offsets.
+func appendBatch(clog batchAppender, records []*api.Record) ([]log.AppendInfo, error) {
+	if clog, ok := clog.(metaBatchAppender); ok {
+		return clog.AppendBatchWithMeta(records)
+	}
+	offsets, err := clog.AppendBatch(records)
+	infos := make([]log.AppendInfo, len(offsets))
+	for i, off := range offsets {
+		infos[i] = log.AppendInfo{Offset: off}
+	}
+	return infos, err
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+// dedupCache is a bounded LRU of dedup keys and the responses to the produces that first used them.
+// Once a key is evicted, a produce with it appends again.
+type dedupCache struct {
+	// mu is only held to look up and store keys, not while producing,
+	// so that produces with different keys don't wait for each other.
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+	// inflight holds the produces in progress by key, so that concurrent retries wait for the first one
+	// rather than both appending.
+	inflight map[string]*dedupCall
+}
+
+type dedupEntry struct {
+	key  string
+	resp *api.ProduceResponse
+}
+
+// dedupCall is a produce in progress. done is closed once resp and err are set.
+type dedupCall struct {
+	done chan struct{}
+	resp *api.ProduceResponse
+	err  error
+}
+
+func newDedupCache(size int) *dedupCache {
+	return &dedupCache{
+		size:     size,
+		order:    list.New(),
+		keys:     make(map[string]*list.Element, size),
+		inflight: make(map[string]*dedupCall),
+	}
+}
+
+// do returns the response remembered for key if there is one.
+// Otherwise it calls produce and, if the produce succeeds, remembers its response for key.
+// If a produce with key is already in progress, do waits for it and returns its response,
+// or tries again if it failed.
+func (c *dedupCache) do(key string, produce func() (*api.ProduceResponse, error)) (*api.ProduceResponse, error) {
+	for {
+		c.mu.Lock()
+		if e, ok := c.keys[key]; ok {
+			c.order.MoveToFront(e)
+			c.mu.Unlock()
+			return e.Value.(*dedupEntry).resp, nil
+		}
+		call, ok := c.inflight[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-call.done
+		if call.err == nil {
+			return call.resp, nil
+		}
+	}
+	call := &dedupCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.resp, call.err = produce()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.keys[key] = c.order.PushFront(&dedupEntry{key: key, resp: call.resp})
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.keys, oldest.Value.(*dedupEntry).key)
+		}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.resp, call.err
+}
+
+// dedupKey returns the key the produce of req is remembered under.
+// Keys are scoped to the request's topic, so that the same key can be used with several topics.
+func dedupKey(req *api.ProduceRequest) string {
+	if req.Topic == "" {
+		return req.DedupKey
+	}
+	// topic names can't hold a NUL, so the topic and key can't run into each other.
+	return req.Topic + "\x00" + req.DedupKey
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TraceIDKey is the metadata key carrying the ID that correlates the logs of an RPC.
+// Clients may set it to tie the server's logs to their own; otherwise the server generates one.
+const TraceIDKey = "x-request-id"
+
+// RPCLog describes a single RPC handled by the server.
+type RPCLog struct {
+	TraceID string
+	// Method is the name of the RPC, e.g. "Produce".
+	Method string
+	// Offset is the offset requested by, or assigned to the record of, a unary RPC.
+	// It is zero for RPCs that carry no offset, and for streams.
+	Offset   uint64
+	Duration time.Duration
+	Code     codes.Code
+	// Subject is the common name of the client's certificate, or "" if there is none.
+	Subject string
+}
+
+// Logger logs the RPCs the server handles.
+// It lets users send the logs to the logging library of their choice.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	LogRPC(RPCLog)
+}
+
+// nopLogger is the Logger used when Config.Logger is nil.
+type nopLogger struct{}
+
+func (nopLogger) LogRPC(RPCLog) {}
+
+type traceIDContextKey struct{}
+
+// TraceIDFromContext returns the trace ID of the RPC being handled with ctx, or "" if there is none.
+func TraceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDContextKey{}).(string)
+	return id
+}
+
+// withTraceID returns ctx carrying the trace ID from the incoming metadata, or a new one if the client sent none.
+// The ID is also added to the outgoing metadata, so that calls made while handling the RPC carry it on.
+func withTraceID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(TraceIDKey); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if id == "" {
+		id = newTraceID()
+	}
+	ctx = context.WithValue(ctx, traceIDContextKey{}, id)
+	return metadata.AppendToOutgoingContext(ctx, TraceIDKey, id)
+}
+
+// newTraceID returns a random 16 byte ID, hex encoded.
+func newTraceID() string {
+	b := make([]byte, 16)
+	// a failure leaves the ID zeroed, which still lets the RPC be served.
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// offsetGetter is implemented by the requests and responses that carry an offset.
+type offsetGetter interface {
+	GetOffset() uint64
+}
+
+// loggingUnaryInterceptor logs every unary RPC once it has been handled.
+func loggingUnaryInterceptor(l Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx = withTraceID(ctx)
+		start := time.Now()
+		resp, err := handler(ctx, req)
+
+		entry := RPCLog{
+			TraceID:  TraceIDFromContext(ctx),
+			Method:   path.Base(info.FullMethod),
+			Duration: time.Since(start),
+			Code:     status.Code(err),
+			Subject:  subjectName(ctx),
+		}
+		if r, ok := req.(offsetGetter); ok {
+			entry.Offset = r.GetOffset()
+		} else if r, ok := resp.(offsetGetter); ok && err == nil {
+			entry.Offset = r.GetOffset()
+		}
+		l.LogRPC(entry)
+		return resp, err
+	}
+}
+
+// loggingStreamInterceptor logs every streaming RPC once it has ended.
+func loggingStreamInterceptor(l Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := withTraceID(ss.Context())
+		start := time.Now()
+		err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+		l.LogRPC(RPCLog{
+			TraceID:  TraceIDFromContext(ctx),
+			Method:   path.Base(info.FullMethod),
+			Duration: time.Since(start),
+			Code:     status.Code(err),
+			Subject:  subjectName(ctx),
+		})
+		return err
+	}
+}
+
+// subjectName returns the common name of the client's verified certificate, or "" if there is none.
+func subjectName(ctx context.Context) string {
+	cn, _, _ := SubjectFromContext(ctx)
+	return cn
+}
+
+// tracedServerStream is a stream whose context carries the RPC's trace ID.
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/jxofficial/proglog/api/v1"
+)
+
+// Metrics records observations about the RPCs the server handles.
+// It lets users back the server's metrics with the library of their choice, e.g. Prometheus or OpenTelemetry.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// AddRecordsProduced adds n to the number of records appended to the log.
+	AddRecordsProduced(n int)
+	// AddRecordsConsumed adds n to the number of records read from the log.
+	AddRecordsConsumed(n int)
+	// IncErrors increments the number of RPCs to method that failed with code.
+	IncErrors(method string, code codes.Code)
+	// ObserveAppendLatency records how long a unary produce RPC took.
+	ObserveAppendLatency(d time.Duration)
+	// ObserveReadLatency records how long a unary consume RPC took.
+	ObserveReadLatency(d time.Duration)
+}
+
+// nopMetrics is the Metrics used when Config.Metrics is nil.
+type nopMetrics struct{}
+
+func (nopMetrics) AddRecordsProduced(int)             {}
+func (nopMetrics) AddRecordsConsumed(int)             {}
+func (nopMetrics) IncErrors(string, codes.Code)       {}
+func (nopMetrics) ObserveAppendLatency(time.Duration) {}
+func (nopMetrics) ObserveReadLatency(time.Duration)   {}
+
+// metricsUnaryInterceptor records the records produced or consumed by, the latency of, and the errors returned by unary RPCs.
+func metricsUnaryInterceptor(m Metrics) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		elapsed := time.Since(start)
+
+		method := path.Base(info.FullMethod)
+		if err != nil {
+			m.IncErrors(method, status.Code(err))
+		}
+		switch method {
+		case "Produce", "ProduceConditional":
+			m.ObserveAppendLatency(elapsed)
+			if err == nil {
+				m.AddRecordsProduced(1)
+			}
+		case "Consume":
+			m.ObserveReadLatency(elapsed)
+			if err == nil {
+				m.AddRecordsConsumed(1)
+			}
+		case "ConsumeBatch":
+			m.ObserveReadLatency(elapsed)
+			if r, ok := resp.(*api.ConsumeBatchResponse); ok && err == nil {
+				m.AddRecordsConsumed(len(r.Records))
+			}
+		}
+		return resp, err
+	}
+}
+
+// metricsStreamInterceptor records the records produced or consumed by, and the errors returned by streaming RPCs.
+// Streams are long-lived, so their latency is not recorded.
+func metricsStreamInterceptor(m Metrics) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		method := path.Base(info.FullMethod)
+		err := handler(srv, &metricsServerStream{ServerStream: ss, metrics: m})
+		if err != nil {
+			m.IncErrors(method, status.Code(err))
+		}
+		return err
+	}
+}
+
+// metricsServerStream counts the records sent on a stream.
+// Every produce response sent acknowledges a record produced, and every consume response sent, except heartbeats,
+// carries a record consumed.
+type metricsServerStream struct {
+	grpc.ServerStream
+	metrics Metrics
+}
+
+func (s *metricsServerStream) SendMsg(msg interface{}) error {
+	if err := s.ServerStream.SendMsg(msg); err != nil {
+		return err
+	}
+	switch msg := msg.(type) {
+	case *api.ProduceResponse:
+		s.metrics.AddRecordsProduced(1)
+	case *api.ConsumeResponse:
+		// heartbeats carry no record.
+		if !msg.Heartbeat {
+			s.metrics.AddRecordsConsumed(1)
+		}
+	}
+	return nil
+}
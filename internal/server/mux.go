@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/soheilhy/cmux"
+)
+
+// ServeMux serves the gRPC server and handler on the same listener, e.g. to expose health checks or metrics over HTTP
+// from a single-port deployment. Connections are told apart by their first bytes:
+// plaintext HTTP/1 requests are served by handler, and every other connection, e.g. a TLS handshake,
+// by the gRPC server, which keeps terminating TLS with the credentials it was created with.
+// It returns once l is closed, which stopping the server does. If serving either protocol fails,
+// it closes l to stop serving the other one too, rather than carry on with one protocol dead, and returns the error.
+func (s *Server) ServeMux(l net.Listener, handler http.Handler) error {
+	m := cmux.New(l)
+	httpL := m.Match(cmux.HTTP1Fast())
+	grpcL := m.Match(cmux.Any())
+
+	httpServer := &http.Server{Handler: handler}
+	defer httpServer.Close()
+	errs := make(chan error, 3)
+	go func() { errs <- httpServer.Serve(httpL) }()
+	go func() { errs <- s.Serve(grpcL) }()
+	go func() { errs <- m.Serve() }()
+
+	// whichever returns first closes l, which makes the others return too,
+	// and the first error that isn't from closing l is returned.
+	var firstErr error
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		if i == 0 {
+			l.Close()
+		}
+		if firstErr == nil && !isClosedErr(err) {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// isClosedErr returns whether err is returned by a server or listener because its listener was closed,
+// as happens when ServeMux stops, rather than because serving failed.
+func isClosedErr(err error) bool {
+	return err == nil ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, http.ErrServerClosed) ||
+		errors.Is(err, cmux.ErrListenerClosed)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc"
+
+	api "github.com/jxofficial/proglog/api/v1"
+	"github.com/jxofficial/proglog/internal/log"
+)
+
+// replicateBackoff is how long Replicate waits before pulling again after the pull from the leader fails.
+const replicateBackoff = 250 * time.Millisecond
+
+// Replica is the log a follower stores the leader's records in, e.g. a *log.Log.
+// HighestOffset returns log.ErrEmptyLog when the replica has no records.
+// SkipTo moves the replica's next offset forward to off, for the offsets the leader has no records at,
+// e.g. because it compacted or truncated them.
+type Replica interface {
+	AppendAt(off uint64, r *api.Record) error
+	SkipTo(off uint64) error
+	HighestOffset() (uint64, error)
+}
+
+// Replicate pulls the records of the leader at leaderAddr into local, keeping each record's offset,
+// until ctx is done, at which point it returns nil.
+// When the pull fails, e.g. because the leader restarted, it pulls again from local's highest offset.
+// Offsets the leader has no records at, e.g. because it compacted them, are skipped in local too.
+// It returns an error if a pulled record can't be appended to local.
+func Replicate(ctx context.Context, leaderAddr string, local Replica, opts ...grpc.DialOption) error {
+	cc, err := grpc.DialContext(ctx, leaderAddr, opts...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+
+	for {
+		err := pull(ctx, client, local)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var pullErr pullError
+		if !errors.As(err, &pullErr) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(replicateBackoff):
+		}
+	}
+}
+
+// pullError is a failure to pull from the leader, after which the pull can be retried.
+type pullError struct {
+	error
+}
+
+// pull appends the records streamed by the leader to local, until the stream fails.
+func pull(ctx context.Context, client api.LogClient, local Replica) error {
+	// an empty replica pulls from offset 0, and the leader's stream skips to its lowest offset.
+	from, err := local.HighestOffset()
+	if err != nil && !errors.Is(err, log.ErrEmptyLog) {
+		return err
+	}
+	// waiting for the leader to be ready lets the pull ride out the leader restarting.
+	stream, err := client.Pull(ctx, &api.PullRequest{FromOffset: from}, grpc.WaitForReady(true))
+	if err != nil {
+		return pullError{err}
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return pullError{err}
+		}
+		err = local.AppendAt(resp.Record.Offset, resp.Record)
+		var seqErr log.ErrOutOfSequence
+		if errors.As(err, &seqErr) {
+			// the pull starts at the highest offset, which local already has, unless it is empty.
+			if seqErr.Offset < seqErr.Next {
+				continue
+			}
+			// the leader has no records at the offsets in between, so local skips them too.
+			if err = local.SkipTo(resp.Record.Offset); err != nil {
+				return err
+			}
+			err = local.AppendAt(resp.Record.Offset, resp.Record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -2,69 +2,742 @@ package server
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 
 	api "github.com/jxofficial/proglog/api/v1"
+	"github.com/jxofficial/proglog/internal/log"
+	"github.com/jxofficial/proglog/internal/version"
 )
 
 type Config struct {
 	CommitLog
+	// MaxConcurrentAppends bounds the number of produces waiting on CommitLog.Append at any time.
+	// Produces beyond the limit are rejected with codes.ResourceExhausted instead of queueing.
+	// Zero means unbounded.
+	MaxConcurrentAppends int
+	// MaxRecordBytes bounds the size of the value of a produced record.
+	// Produces of larger records are rejected with codes.InvalidArgument.
+	// Zero means unbounded.
+	MaxRecordBytes int
+	// Authorizer authorizes clients, identified by their certificate's common name, to call the RPCs.
+	// If nil, every client is authorized.
+	Authorizer Authorizer
+	// Metrics records the records produced and consumed, the latency of produces and consumes,
+	// and the errors returned by the RPCs. If nil, nothing is recorded.
+	Metrics Metrics
+	// DedupCacheSize is the number of most recent dedup keys of produce requests the server remembers.
+	// A produce with a remembered key returns the response of the produce that first used the key, without appending.
+	// Zero disables deduplication.
+	DedupCacheSize int
+	// ProduceStreamBatchSize is the number of records ProduceStream appends at once,
+	// when the commit log supports appending batches. The offsets of a batch's records are sent
+	// once the whole batch is appended. Zero or one appends each record on its own.
+	ProduceStreamBatchSize int
+	// ProduceStreamFlushInterval is how long ProduceStream waits for a batch to fill up
+	// before appending the records received so far. It defaults to 10ms.
+	ProduceStreamFlushInterval time.Duration
+	// ConsumeStreamHeartbeatInterval is how long ConsumeStream goes without sending a record before it sends a heartbeat,
+	// a response without a record, so that intermediaries such as load balancers don't drop idle streams.
+	// Zero disables heartbeats.
+	ConsumeStreamHeartbeatInterval time.Duration
+	// MaxConsumeBatchRecords bounds the number of records ConsumeBatch returns,
+	// whatever number of records the request asks for. It defaults to 1000.
+	MaxConsumeBatchRecords int
+	// Logger logs every RPC, with its trace ID, duration, and status code. If nil, nothing is logged.
+	Logger Logger
+	// Offsets stores the offsets committed by consumer groups.
+	// If nil, CommitOffset and FetchOffset return codes.Unimplemented, and streams can't resume.
+	Offsets OffsetCommitter
+	// ServerLimits bounds the resources client connections can take up on the server.
+	ServerLimits ServerLimits
+	// Topics hosts the logs that produces and consumes naming a topic are routed to.
+	// Requests without a topic are served from CommitLog.
+	// If nil, requests naming a topic return codes.NotFound.
+	Topics Topics
 }
 
+// ServerLimits bounds the resources client connections can take up on the server,
+// so that a misbehaving client can't exhaust them. Zero values leave gRPC's defaults in place.
+type ServerLimits struct {
+	// MaxConcurrentStreams bounds the number of RPCs, unary or streaming, each connection has in flight at once.
+	// RPCs beyond the limit are not served until earlier ones end.
+	MaxConcurrentStreams uint32
+	// KeepaliveTime is how long a connection goes without activity before the server pings the client,
+	// and KeepaliveTimeout is how long the server waits for the ping's ack before closing the connection.
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// MinClientPingInterval is how often clients may ping the server.
+	// Connections of clients pinging more often are closed.
+	MinClientPingInterval time.Duration
+	// ConnectionIdleTimeout is how long a connection goes without RPCs before the server closes it.
+	ConnectionIdleTimeout time.Duration
+	// ConnectionTimeout bounds how long a new connection has to complete its handshake.
+	ConnectionTimeout time.Duration
+}
+
+// serverOptions returns the gRPC server options that apply the limits.
+func (l ServerLimits) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if l.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(l.MaxConcurrentStreams))
+	}
+	if l.KeepaliveTime > 0 || l.KeepaliveTimeout > 0 || l.ConnectionIdleTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:              l.KeepaliveTime,
+			Timeout:           l.KeepaliveTimeout,
+			MaxConnectionIdle: l.ConnectionIdleTimeout,
+		}))
+	}
+	if l.MinClientPingInterval > 0 {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime: l.MinClientPingInterval,
+		}))
+	}
+	if l.ConnectionTimeout > 0 {
+		opts = append(opts, grpc.ConnectionTimeout(l.ConnectionTimeout))
+	}
+	return opts
+}
+
+// OffsetCommitter stores the offset each consumer group has consumed up to, e.g. a *log.OffsetStore.
+// Fetch returns log.ErrNoCommittedOffset for a group that has not committed an offset.
+type OffsetCommitter interface {
+	Commit(group string, off uint64) error
+	Fetch(group string) (uint64, error)
+}
+
+// Topics hosts the logs of named topics, e.g. a *log.LogManager.
+// Topic returns log.ErrTopicNotFound for a topic it does not host.
+type Topics interface {
+	Topic(name string) (*log.Log, error)
+}
+
+// Authorizer decides whether subject may perform action on object.
+// It returns a non-nil error if the action is not permitted.
+type Authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+// logServiceName is the name of the Log service, under which its health is reported.
+const logServiceName = "log.v1.Log"
+
+const (
+	// maxRecvMsgOverhead is the room left in a received message, beyond MaxRecordBytes,
+	// for the rest of the record and the request wrapping it.
+	maxRecvMsgOverhead = 4 << 10
+)
+
+const (
+	objectWildcard = "*"
+	produceAction  = "produce"
+	consumeAction  = "consume"
+)
+
+// CommitLog is the log the server serves.
+// HighestOffset returns log.ErrEmptyLog when the log has no records.
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+// conditionalAppender is implemented by commit logs that support compare-and-append.
+type conditionalAppender interface {
+	AppendIfOffset(expected uint64, r *api.Record) (uint64, error)
+}
+
+// metaAppender is implemented by commit logs that can report where an appended record is stored.
+type metaAppender interface {
+	AppendWithMeta(ctx context.Context, r *api.Record) (log.AppendInfo, error)
+}
+
+// contextReader is implemented by commit logs whose reads can be cancelled.
+type contextReader interface {
+	ReadContext(ctx context.Context, off uint64) (*api.Record, error)
+}
+
+// nextReader is implemented by commit logs that can read the first record at or after an offset,
+// skipping offsets without records.
+type nextReader interface {
+	ReadNext(off uint64) (*api.Record, error)
+}
+
+// latestReader is implemented by commit logs that can read their latest record.
+type latestReader interface {
+	ReadLatest() (*api.Record, error)
+}
+
+// batchAppender is implemented by commit logs that can append several records at once.
+type batchAppender interface {
+	AppendBatch(records []*api.Record) ([]uint64, error)
+}
+
+// metaBatchAppender is implemented by commit logs that can append several records at once
+// and report where each of them is stored.
+type metaBatchAppender interface {
+	AppendBatchWithMeta(records []*api.Record) ([]log.AppendInfo, error)
+}
+
+// waiter is implemented by commit logs that can notify when a record is appended.
+type waiter interface {
+	Wait(ctx context.Context, off uint64) error
 }
 
 type grpcServer struct {
 	*Config
 	api.UnimplementedLogServer
+	// appendSem holds a token for every in-flight append when MaxConcurrentAppends is set.
+	appendSem chan struct{}
+	// dedup remembers the responses to produces with dedup keys when DedupCacheSize is set.
+	dedup *dedupCache
+	// shutdown is closed by Shutdown to end the active consume streams.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// consumeStreamBackoff is how long a consume stream that has caught up with the log waits before reading again,
+// when the commit log can't notify when a record is appended.
+const consumeStreamBackoff = 10 * time.Millisecond
+
+// Server is a gRPC server serving the Log service.
+type Server struct {
+	*grpc.Server
+	srv *grpcServer
+}
+
+// Shutdown ends the active consume streams, which otherwise only end when their clients cancel them,
+// and makes new consume streams end as soon as they catch up with the log.
+// It is meant to be called before stopping the server.
+func (s *Server) Shutdown() {
+	s.srv.Shutdown()
+}
+
+// GracefulStop ends the active consume streams, then stops the server gracefully,
+// waiting for the other pending RPCs to finish.
+func (s *Server) GracefulStop() {
+	s.Shutdown()
+	s.Server.GracefulStop()
 }
 
-func NewGRPCServer(c *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+func NewGRPCServer(c *Config, opts ...grpc.ServerOption) (*Server, error) {
+	var metrics Metrics = nopMetrics{}
+	if c.Metrics != nil {
+		metrics = c.Metrics
+	}
+	var logger Logger = nopLogger{}
+	if c.Logger != nil {
+		logger = c.Logger
+	}
+	defaults := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(loggingUnaryInterceptor(logger), metricsUnaryInterceptor(metrics)),
+		grpc.ChainStreamInterceptor(loggingStreamInterceptor(logger), metricsStreamInterceptor(metrics)),
+	}
+	if c.MaxRecordBytes > 0 {
+		// requests with records just over the limit must still be received, so that they are rejected with a clear error.
+		defaults = append(defaults, grpc.MaxRecvMsgSize(c.MaxRecordBytes+maxRecvMsgOverhead))
+	}
+	// opts come last, so that they take precedence over the options the config sets.
+	defaults = append(defaults, c.ServerLimits.serverOptions()...)
+	opts = append(defaults, opts...)
 	gsrv := grpc.NewServer(opts...)
 	srv, err := newgrpcServer(c)
 	if err != nil {
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
-	return gsrv, nil
+
+	// the server can only serve once it has a commit log to serve from.
+	hsrv := health.NewServer()
+	servingStatus := healthpb.HealthCheckResponse_NOT_SERVING
+	if c.CommitLog != nil {
+		servingStatus = healthpb.HealthCheckResponse_SERVING
+	}
+	hsrv.SetServingStatus("", servingStatus)
+	hsrv.SetServingStatus(logServiceName, servingStatus)
+	healthpb.RegisterHealthServer(gsrv, hsrv)
+	return &Server{Server: gsrv, srv: srv}, nil
+}
+
+// CheckHealth returns the serving status of the Log service of the server at the other end of cc.
+func CheckHealth(ctx context.Context, cc grpc.ClientConnInterface) (healthpb.HealthCheckResponse_ServingStatus, error) {
+	resp, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: logServiceName,
+	})
+	if err != nil {
+		return healthpb.HealthCheckResponse_UNKNOWN, err
+	}
+	return resp.Status, nil
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	*api.ProduceResponse,
 	error,
 ) {
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	if err := s.prepareProduce(req.Record, req.Codec); err != nil {
+		return nil, err
+	}
+	return s.produceRequest(ctx, req)
+}
+
+// produceRequest appends the request's record to the log of the request's topic,
+// only once per dedup key if deduplication is enabled.
+// Unlike Produce, it doesn't authorize the request or prepare its record, which the caller must have done,
+// e.g. once for a whole stream.
+func (s *grpcServer) produceRequest(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	clog, err := s.commitLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	if s.dedup == nil || req.DedupKey == "" {
+		resp, err := s.produce(ctx, clog, req.Record)
+		return resp, topicError(req.Topic, err)
+	}
+	resp, err := s.dedup.do(dedupKey(req), func() (*api.ProduceResponse, error) {
+		return s.produce(ctx, clog, req.Record)
+	})
+	return resp, topicError(req.Topic, err)
+}
+
+// commitLog returns the commit log of topic: CommitLog for the default topic, "", and the topic's log otherwise.
+// It returns codes.NotFound if there is no such topic.
+func (s *grpcServer) commitLog(topic string) (CommitLog, error) {
+	if topic == "" {
+		return s.CommitLog, nil
+	}
+	if s.Topics == nil {
+		return nil, status.Errorf(codes.NotFound, "topic %q not found", topic)
+	}
+	clog, err := s.Topics.Topic(topic)
+	var notFound log.ErrTopicNotFound
+	if errors.As(err, &notFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return clog, nil
+}
+
+// topicError returns codes.NotFound for err if it is from the log of a topic that was deleted while it was in use,
+// as if the topic was already deleted when the request arrived, and returns any other error as is.
+func topicError(topic string, err error) error {
+	if topic != "" && errors.Is(err, log.ErrLogClosed) {
+		return status.Errorf(codes.NotFound, "topic %q not found", topic)
+	}
+	return err
+}
+
+// prepareProduce checks that a produced record can be appended, and records codec, the request's codec, on it.
+func (s *grpcServer) prepareProduce(record *api.Record, codec api.Codec) error {
+	if err := s.checkRecordSize(record); err != nil {
+		return err
+	}
+	if _, ok := api.Codec_name[int32(codec)]; !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown codec %d", codec)
+	}
+	if codec != api.Codec_CODEC_NONE && record != nil {
+		record.Codec = codec
+	}
+	return nil
+}
+
+// produce appends the record to clog.
+func (s *grpcServer) produce(ctx context.Context, clog CommitLog, record *api.Record) (*api.ProduceResponse, error) {
+	release, err := s.acquireAppend()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if clog, ok := clog.(metaAppender); ok {
+		info, err := clog.AppendWithMeta(ctx, record)
+		if err != nil {
+			return nil, contextError(err)
+		}
+		return &api.ProduceResponse{
+			Offset:     info.Offset,
+			Position:   info.Position,
+			BaseOffset: info.BaseOffset,
+		}, nil
+	}
+	offset, err := clog.Append(record)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: offset}, nil
+}
+
+// ProduceConditional appends the record only if it is assigned the request's expected offset.
+// It returns codes.Aborted if another record was appended first.
+func (s *grpcServer) ProduceConditional(ctx context.Context, req *api.ProduceConditionalRequest) (
+	*api.ProduceResponse,
+	error,
+) {
+	if err := s.authorize(ctx, produceAction); err != nil {
+		return nil, err
+	}
+	commitLog, err := s.commitLog(req.Topic)
 	if err != nil {
 		return nil, err
 	}
+	clog, ok := commitLog.(conditionalAppender)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not support conditional appends")
+	}
+	if err := s.prepareProduce(req.Record, req.Codec); err != nil {
+		return nil, err
+	}
+	release, err := s.acquireAppend()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	offset, err := clog.AppendIfOffset(req.ExpectedOffset, req.Record)
+	if err != nil {
+		return nil, topicError(req.Topic, err)
+	}
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// checkRecordSize returns codes.InvalidArgument if the record's value is larger than MaxRecordBytes.
+func (s *grpcServer) checkRecordSize(record *api.Record) error {
+	if s.MaxRecordBytes <= 0 || len(record.GetValue()) <= s.MaxRecordBytes {
+		return nil
+	}
+	return status.Errorf(
+		codes.InvalidArgument,
+		"record value is %d bytes, larger than the maximum of %d bytes",
+		len(record.GetValue()),
+		s.MaxRecordBytes,
+	)
+}
+
+// authorize checks that the client calling the RPC is permitted to perform action.
+// It returns codes.PermissionDenied if it is not.
+func (s *grpcServer) authorize(ctx context.Context, action string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	cn, _, _ := SubjectFromContext(ctx)
+	err := s.Authorizer.Authorize(cn, objectWildcard, action)
+	if err == nil {
+		return nil
+	}
+	if st, ok := status.FromError(err); ok && st.Code() == codes.PermissionDenied {
+		return err
+	}
+	return status.Error(codes.PermissionDenied, err.Error())
+}
+
+// SubjectFromContext returns the common name of the verified certificate of the client calling the RPC handled with ctx,
+// and the client's address. ok reports whether the client presented a verified certificate;
+// if not, cn is "", and addr is still set if the client's address is known.
+// It identifies clients to authorization, logging and per-client metrics alike.
+func SubjectFromContext(ctx context.Context) (cn string, addr string, ok bool) {
+	p, found := peer.FromContext(ctx)
+	if !found {
+		return "", "", false
+	}
+	if p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	tlsInfo, isTLS := p.AuthInfo.(credentials.TLSInfo)
+	if !isTLS || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return "", addr, false
+	}
+	return tlsInfo.State.VerifiedChains[0][0].Subject.CommonName, addr, true
+}
+
+// acquireAppend takes a token for an append when MaxConcurrentAppends is set.
+// It returns codes.ResourceExhausted if there are no tokens left,
+// otherwise a func that must be called to return the token once the append is done.
+func (s *grpcServer) acquireAppend() (release func(), err error) {
+	if s.appendSem == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.appendSem <- struct{}{}:
+		return func() { <-s.appendSem }, nil
+	default:
+		return nil, status.Errorf(
+			codes.ResourceExhausted,
+			"too many concurrent appends: limit is %d",
+			s.MaxConcurrentAppends,
+		)
+	}
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse,
 	error,
 ) {
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, err := s.commitLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.consume(ctx, clog, req)
+	return resp, topicError(req.Topic, err)
+}
+
+// consume serves req from clog, like Consume, for a client that is already authorized to consume.
+func (s *grpcServer) consume(ctx context.Context, clog CommitLog, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	record, err := s.read(ctx, clog, req.Offset)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok && req.ConsumeNext {
+		record, err = s.readLowest(ctx, clog, req.Offset, err)
+	}
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok && req.WaitFor.AsDuration() > 0 {
+		record, err = s.waitAndRead(ctx, clog, req)
+	}
+	if err != nil {
+		return nil, contextError(err)
+	}
+	return &api.ConsumeResponse{Record: record, Codec: record.Codec}, nil
+}
+
+// read reads the record at off from clog, giving up if ctx is done first when clog supports it.
+func (s *grpcServer) read(ctx context.Context, clog CommitLog, off uint64) (*api.Record, error) {
+	if clog, ok := clog.(contextReader); ok {
+		return clog.ReadContext(ctx, off)
+	}
+	return clog.Read(off)
+}
+
+// readLowest reads the record at clog's lowest offset if off is below it,
+// and otherwise returns err, the error reading off.
+func (s *grpcServer) readLowest(ctx context.Context, clog CommitLog, off uint64, err error) (*api.Record, error) {
+	lowest, lerr := clog.LowestOffset()
+	if lerr != nil || off >= lowest {
+		return nil, err
+	}
+	return s.read(ctx, clog, lowest)
+}
+
+// contextError converts a context's error into the equivalent gRPC status error,
+// and returns any other error as is.
+func contextError(err error) error {
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return err
+}
+
+// maxConsumeBatchRecords is the default Config.MaxConsumeBatchRecords.
+const maxConsumeBatchRecords = 1000
+
+// ConsumeBatch returns up to req.MaxRecords records starting from req.Offset, and no more than MaxConsumeBatchRecords,
+// stopping early without an error at the end of the log. Offsets without records, e.g. compacted ones, are skipped.
+// It returns the commit log's error if no record can be read from the first offset onwards.
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (
+	*api.ConsumeBatchResponse,
+	error,
+) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if req.MaxRecords == 0 {
+		return nil, status.Error(codes.InvalidArgument, "max records must be positive")
+	}
+	max := uint64(req.MaxRecords)
+	limit := s.MaxConsumeBatchRecords
+	if limit <= 0 {
+		limit = maxConsumeBatchRecords
+	}
+	if max > uint64(limit) {
+		max = uint64(limit)
+	}
+	clog, err := s.commitLog(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.ConsumeBatchResponse{}
+	for off := req.Offset; uint64(len(resp.Records)) < max; {
+		record, err := s.readNext(ctx, clog, off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok && len(resp.Records) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, topicError(req.Topic, contextError(err))
+		}
+		resp.Records = append(resp.Records, record)
+		off = record.Offset + 1
+	}
+	return resp, nil
+}
+
+// readNext reads the record at off from clog, or the first record after it if off has no record within clog's range,
+// e.g. because it was compacted away, jumping over every offset without a record at once if clog supports it.
+// Offsets outside clog's range are out of range, as with read.
+func (s *grpcServer) readNext(ctx context.Context, clog CommitLog, off uint64) (*api.Record, error) {
+	record, err := s.read(ctx, clog, off)
+	if _, ok := err.(api.ErrOffsetOutOfRange); !ok {
+		return record, err
+	}
+	lowest, lerr := clog.LowestOffset()
+	highest, herr := clog.HighestOffset()
+	// the highest record is never compacted away, so only offsets between the lowest and the highest can be skipped.
+	if lerr != nil || herr != nil || off < lowest || off >= highest {
+		return nil, err
+	}
+	if clog, ok := clog.(nextReader); ok {
+		return clog.ReadNext(off)
+	}
+	for off++; off <= highest; off++ {
+		record, err := s.read(ctx, clog, off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); !ok {
+			return record, err
+		}
+	}
+	return nil, err
+}
+
+// waitAndRead waits up to req.WaitFor for the requested offset to be appended, then reads it.
+// If the offset is not appended in time, it returns clog's out of range error.
+func (s *grpcServer) waitAndRead(ctx context.Context, clog CommitLog, req *api.ConsumeRequest) (*api.Record, error) {
+	w, ok := clog.(waiter)
+	if !ok {
+		// the commit log can't be waited on, so the record is read right away.
+		return clog.Read(req.Offset)
+	}
+	ctx, cancel := context.WithTimeout(ctx, req.WaitFor.AsDuration())
+	defer cancel()
+	// the error is ignored as the read reports whether the offset exists.
+	_ = w.Wait(ctx, req.Offset)
+	return clog.Read(req.Offset)
+}
+
+// GetOffsetRange returns the range of offsets that can be consumed.
+func (s *grpcServer) GetOffsetRange(ctx context.Context, _ *emptypb.Empty) (
+	*api.OffsetRangeResponse,
+	error,
+) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	lowest, err := s.CommitLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	highest, err := s.CommitLog.HighestOffset()
+	if errors.Is(err, log.ErrEmptyLog) {
+		return &api.OffsetRangeResponse{Lowest: lowest, Empty: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.OffsetRangeResponse{Lowest: lowest, Highest: highest}, nil
+}
+
+// GetLatest returns the record with the highest offset.
+// It returns codes.NotFound if the log has no records.
+func (s *grpcServer) GetLatest(ctx context.Context, _ *emptypb.Empty) (*api.ConsumeResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, ok := s.CommitLog.(latestReader)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "commit log does not support reading the latest record")
+	}
+	record, err := clog.ReadLatest()
+	if errors.Is(err, log.ErrEmptyLog) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeResponse{Record: record, Codec: record.Codec}, nil
+}
+
+// CommitOffset records the offset of the next record the request's consumer group consumes.
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "server does not store committed offsets")
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "group is required")
+	}
+	if err := s.Offsets.Commit(req.Group, req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// FetchOffset returns the offset last committed by the request's consumer group.
+// It returns codes.NotFound if the group has not committed an offset.
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if err := s.authorize(ctx, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.Offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "server does not store committed offsets")
+	}
+	off, err := s.Offsets.Fetch(req.Group)
+	if errors.Is(err, log.ErrNoCommittedOffset) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: record}, nil
+	return &api.FetchOffsetResponse{Offset: off}, nil
+}
+
+// GetVersion returns the build information of the server, and the on-disk format version of its log.
+func (s *grpcServer) GetVersion(ctx context.Context, req *api.GetVersionRequest) (
+	*api.GetVersionResponse,
+	error,
+) {
+	return &api.GetVersionResponse{
+		Version:          version.Version,
+		Commit:           version.Commit,
+		BuildTime:        version.BuildTime,
+		LogFormatVersion: log.FormatVersion,
+	}, nil
 }
 
 // ProduceStream calls grpcServer.Produce() for every req in the stream.
 // It sends the response back into the stream.
 // It implements a bidirectional streaming RPC.
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	if err := s.authorize(stream.Context(), produceAction); err != nil {
+		return err
+	}
+	if clog, ok := s.CommitLog.(batchAppender); ok && s.ProduceStreamBatchSize > 1 {
+		return s.produceStreamBatched(stream, clog)
+	}
 	for {
 		req, err := stream.Recv()
 		if err != nil {
 			return err
 		}
 
-		resp, err := s.Produce(stream.Context(), req)
+		// the stream is authorized when it opens, rather than for every record it receives.
+		if err := s.prepareProduce(req.Record, req.Codec); err != nil {
+			return err
+		}
+		resp, err := s.produceRequest(stream.Context(), req)
 		if err != nil {
 			return err
 		}
@@ -79,32 +752,209 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 // ConsumeStream is implements a server side RPC stream, which serves every record following request offset,
 // including records that are not in the log (yet).
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	if err := s.authorize(stream.Context(), consumeAction); err != nil {
+		return err
+	}
+	if req.ResumeGroup != "" && req.Topic != "" {
+		// groups commit offsets of the default log, which mean nothing in the topic's log.
+		return status.Error(codes.InvalidArgument, "resume group can't be used with a topic")
+	}
+	clog, err := s.commitLog(req.Topic)
+	if err != nil {
+		return err
+	}
+	if req.FromLast > 0 {
+		off, err := s.offsetFromLast(clog, req.FromLast)
+		if err != nil {
+			return topicError(req.Topic, err)
+		}
+		req.Offset = off
+	}
+	if req.ResumeGroup != "" {
+		if s.Offsets == nil {
+			return status.Error(codes.Unimplemented, "server does not store committed offsets")
+		}
+		off, err := s.Offsets.Fetch(req.ResumeGroup)
+		switch {
+		case err == nil:
+			req.Offset = off
+		case !errors.Is(err, log.ErrNoCommittedOffset):
+			return err
+		}
+	}
+	send := func(record *api.Record) error {
+		return stream.Send(&api.ConsumeResponse{Record: record, Codec: record.Codec})
+	}
+	heartbeat := func() error {
+		return stream.Send(&api.ConsumeResponse{Heartbeat: true})
+	}
+	return topicError(req.Topic, s.streamFrom(stream.Context(), clog, req, send, heartbeat))
+}
+
+// Pull streams the leader's records to a follower, from the requested offset onwards,
+// including records that are not in the log (yet).
+func (s *grpcServer) Pull(req *api.PullRequest, stream api.Log_PullServer) error {
+	if err := s.authorize(stream.Context(), consumeAction); err != nil {
+		return err
+	}
+	return s.streamFrom(stream.Context(), s.CommitLog, &api.ConsumeRequest{Offset: req.FromOffset}, func(record *api.Record) error {
+		return stream.Send(&api.PullResponse{Record: record})
+	}, nil)
+}
+
+// streamFrom calls send with every record of clog from req's offset onwards, waiting for records that are not in clog yet.
+// req's topic must be clog's. The client must be authorized to consume, which is checked once when its stream opens.
+// While waiting, it calls heartbeat, unless nil, whenever ConsumeStreamHeartbeatInterval passes without a record sent.
+// It returns once req's end offset is reached, the stream's ctx is done, or the server shuts down.
+func (s *grpcServer) streamFrom(
+	ctx context.Context,
+	clog CommitLog,
+	req *api.ConsumeRequest,
+	send func(*api.Record) error,
+	heartbeat func() error,
+) error {
+	// ctx is done when either the client cancels the stream or the server shuts down.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	lastSent := time.Now()
 	for {
+		if req.EndOffset > 0 && req.Offset > req.EndOffset {
+			return nil
+		}
 		select {
-		case <-stream.Context().Done():
+		case <-ctx.Done():
 			return nil
 		default:
-			resp, err := s.Consume(stream.Context(), req)
+			resp, err := s.consume(ctx, clog, req)
 			switch err.(type) {
 			case nil:
 			// if record currently does not exist, the stream will wait
 			case api.ErrOffsetOutOfRange:
+				// the highest record is never compacted away, so an offset below it without a record
+				// was compacted away, and the stream skips it rather than waiting for it.
+				if highest, err := clog.HighestOffset(); err == nil && req.Offset < highest {
+					req.Offset = s.nextOffset(clog, req.Offset)
+					continue
+				}
+				// a bounded stream ends once it has caught up, rather than waiting for records up to its end offset.
+				if req.EndOffset > 0 {
+					return nil
+				}
+				if err := s.waitOrHeartbeat(ctx, clog, req.Offset, &lastSent, heartbeat); err != nil {
+					return err
+				}
 				continue
 			default:
+				// the read was cut short because the stream ended.
+				if ctx.Err() != nil {
+					return nil
+				}
 				return err
 			}
-			err = stream.Send(resp)
-			if err != nil {
+			if err := send(resp.Record); err != nil {
 				return err
 			}
+			lastSent = time.Now()
 			req.Offset++
 		}
 	}
 }
 
+// nextOffset returns the offset of the first record of clog after off, which has no record,
+// jumping over every offset without a record at once if clog supports it, or else off+1.
+func (s *grpcServer) nextOffset(clog CommitLog, off uint64) uint64 {
+	if clog, ok := clog.(nextReader); ok {
+		if record, err := clog.ReadNext(off); err == nil {
+			return record.Offset
+		}
+	}
+	return off + 1
+}
+
+// waitForAppend blocks until the record with offset off is appended to clog, or ctx is done.
+// If clog can't notify when a record is appended, it waits for consumeStreamBackoff instead.
+func (s *grpcServer) waitForAppend(ctx context.Context, clog CommitLog, off uint64) {
+	if w, ok := clog.(waiter); ok {
+		// the error is ignored as the caller checks ctx, and reads the record again.
+		_ = w.Wait(ctx, off)
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(consumeStreamBackoff):
+	}
+}
+
+// waitOrHeartbeat waits for the record with offset off to be appended, like waitForAppend,
+// but only until ConsumeStreamHeartbeatInterval has passed since *lastSent, at which point it calls heartbeat
+// and resets *lastSent. Without a heartbeat or an interval, it just waits.
+func (s *grpcServer) waitOrHeartbeat(
+	ctx context.Context,
+	clog CommitLog,
+	off uint64,
+	lastSent *time.Time,
+	heartbeat func() error,
+) error {
+	interval := s.ConsumeStreamHeartbeatInterval
+	if heartbeat == nil || interval <= 0 {
+		s.waitForAppend(ctx, clog, off)
+		return nil
+	}
+	deadline := lastSent.Add(interval)
+	waitCtx, cancel := context.WithDeadline(ctx, deadline)
+	s.waitForAppend(waitCtx, clog, off)
+	cancel()
+	if ctx.Err() != nil || time.Now().Before(deadline) {
+		return nil
+	}
+	*lastSent = time.Now()
+	return heartbeat()
+}
+
+// offsetFromLast returns the offset of the n-th most recent record of clog,
+// or the lowest offset if clog has fewer than n records.
+func (s *grpcServer) offsetFromLast(clog CommitLog, n uint64) (uint64, error) {
+	// the highest offset is read first, so that a concurrent truncation can only raise the lowest offset,
+	// which keeps the result within the log's range.
+	highest, err := clog.HighestOffset()
+	empty := errors.Is(err, log.ErrEmptyLog)
+	if err != nil && !empty {
+		return 0, err
+	}
+	lowest, err := clog.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	if empty || highest+1 < n || highest+1-n < lowest {
+		return lowest, nil
+	}
+	return highest + 1 - n, nil
+}
+
+// Shutdown ends the active consume streams, see Server.Shutdown.
+func (s *grpcServer) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+}
+
 func newgrpcServer(c *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{
-		Config: c,
+		Config:   c,
+		shutdown: make(chan struct{}),
+	}
+	if c.MaxConcurrentAppends > 0 {
+		srv.appendSem = make(chan struct{}, c.MaxConcurrentAppends)
+	}
+	if c.DedupCacheSize > 0 {
+		srv.dedup = newDedupCache(c.DedupCacheSize)
 	}
 	return srv, nil
 }
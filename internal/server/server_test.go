@@ -1,19 +1,39 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
 
 	api "github.com/jxofficial/proglog/api/v1"
 	"github.com/jxofficial/proglog/internal/config"
 	"github.com/jxofficial/proglog/internal/log"
+	"github.com/jxofficial/proglog/internal/log/inmem"
+	"github.com/jxofficial/proglog/internal/version"
 )
 
 func TestServer(t *testing.T) {
@@ -25,6 +45,18 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeds":                                    testProduceConsume,
 		"consume past boundary returns nil ConsumeResponse and error with expected status code": testConsumePastBoundary,
 		"consume stream returns records in stream":                                              testProduceConsumeStream,
+		"get version returns the injected build information":                                    testGetVersion,
+		"produce conditional only appends at the expected offset":                               testProduceConditional,
+		"consume with wait for returns a record produced while waiting":                         testConsumeWaitFor,
+		"consume stream from last starts from the most recent records then tails":               testConsumeStreamFromLast,
+		"consume batch returns partial batches near the tail":                                   testConsumeBatch,
+		"produce returns the position and segment base offset of the record":                    testProducePosition,
+		"get offset range returns the lowest and highest offsets":                               testGetOffsetRange,
+		"get latest returns the record with the highest offset":                                 testGetLatest,
+		"produce with a codec stores the compressed value and reports the codec on consume":     testProduceCodec,
+		"consume stream with end offset ends after the end offset":                              testConsumeStreamEndOffset,
+		"produce/consume keeps the record's headers":                                            testProduceConsumeHeaders,
+		"produce/consume without a topic uses the default log":                                  testProduceConsumeDefaultTopic,
 	}
 
 	for scenario, fn := range tt {
@@ -36,6 +68,306 @@ func TestServer(t *testing.T) {
 	}
 }
 
+// slowCommitLog blocks every Append until release is closed.
+type slowCommitLog struct {
+	CommitLog
+	appending chan struct{}
+	release   chan struct{}
+}
+
+func (l *slowCommitLog) Append(r *api.Record) (uint64, error) {
+	l.appending <- struct{}{}
+	<-l.release
+	return l.CommitLog.Append(r)
+}
+
+func TestServerMaxConcurrentAppends(t *testing.T) {
+	slow := &slowCommitLog{
+		appending: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		slow.CommitLog = c.CommitLog
+		c.CommitLog = slow
+		c.MaxConcurrentAppends = 2
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+
+	// saturate the semaphore with appends that block until released.
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.Produce(ctx, req)
+			errs <- err
+		}()
+		<-slow.appending
+	}
+
+	_, err := client.Produce(ctx, req)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	close(slow.release)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// the semaphore is free again once the appends complete.
+	go func() { <-slow.appending }()
+	_, err = client.Produce(ctx, req)
+	require.NoError(t, err)
+}
+
+func TestServerMaxConcurrentStreams(t *testing.T) {
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.ServerLimits.MaxConcurrentStreams = 1
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// the open stream takes up the connection's only stream, so another RPC isn't served.
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer timeoutCancel()
+	_, err = client.Consume(timeoutCtx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// once the stream ends, the RPC is served.
+	cancel()
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+}
+
+func TestServerConsumeNext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// each record fills up a segment, so that truncating removes records one by one.
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 32
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("hello world %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	// removes the records up to offset 1.
+	require.NoError(t, clog.Truncate(1))
+
+	outOfRange := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, outOfRange, status.Code(err))
+
+	// the removed offset resumes from the lowest offset.
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, ConsumeNext: true})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), consume.Record.Offset)
+	require.Equal(t, []byte("hello world 2"), consume.Record.Value)
+
+	// offsets past the end of the log are still out of range.
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3, ConsumeNext: true})
+	require.Equal(t, outOfRange, status.Code(err))
+}
+
+func TestServerTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewLogManager(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	for _, topic := range []string{"orders", "payments"} {
+		_, err := topics.CreateTopic(topic, log.Config{})
+		require.NoError(t, err)
+	}
+	client, cfg, teardown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	values := map[string][]string{
+		"orders":   {"order 0", "order 1"},
+		"payments": {"payment 0"},
+	}
+	for topic, vs := range values {
+		for i, v := range vs {
+			produce, err := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte(v)},
+				Topic:  topic,
+			})
+			require.NoError(t, err)
+			// each topic has its own offsets.
+			require.Equal(t, uint64(i), produce.Offset)
+		}
+	}
+
+	for topic, vs := range values {
+		for i, v := range vs {
+			consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: uint64(i), Topic: topic})
+			require.NoError(t, err)
+			require.Equal(t, []byte(v), consume.Record.Value)
+		}
+		_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: uint64(len(vs)), Topic: topic})
+		require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+		batch, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{MaxRecords: 10, Topic: topic})
+		require.NoError(t, err)
+		require.Len(t, batch.Records, len(vs))
+		for i, v := range vs {
+			require.Equal(t, []byte(v), batch.Records[i].Value)
+		}
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{Topic: topic})
+		require.NoError(t, err)
+		for _, v := range vs {
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, []byte(v), resp.Record.Value)
+		}
+		cancel()
+	}
+
+	// conditional produces are routed to the topic, and expect the topic's offsets.
+	produce, err := client.ProduceConditional(ctx, &api.ProduceConditionalRequest{
+		Record:         &api.Record{Value: []byte("payment 1")},
+		ExpectedOffset: 1,
+		Topic:          "payments",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), produce.Offset)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1, Topic: "payments"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("payment 1"), consume.Record.Value)
+
+	// the default log holds none of the topics' records.
+	_, err = cfg.CommitLog.HighestOffset()
+	require.True(t, errors.Is(err, log.ErrEmptyLog))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, Topic: "refunds"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("refund 0")},
+		Topic:  "refunds",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// deletedTopics serves the log of a topic that was deleted after it was looked up,
+// as when a request races the topic's deletion.
+type deletedTopics struct {
+	log *log.Log
+}
+
+func (t deletedTopics) Topic(string) (*log.Log, error) {
+	return t.log, nil
+}
+
+func TestServerDeletedTopic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewLogManager(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	orders, err := topics.CreateTopic("orders", log.Config{})
+	require.NoError(t, err)
+	_, err = orders.Append(&api.Record{Value: []byte("order 0")})
+	require.NoError(t, err)
+	require.NoError(t, topics.DeleteTopic("orders"))
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = deletedTopics{log: orders}
+		c.DedupCacheSize = 1
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("order 1")},
+		Topic:  "orders",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:   &api.Record{Value: []byte("order 1")},
+		Topic:    "orders",
+		DedupKey: "order 1",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServerTopicsCantResumeGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := log.NewLogManager(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+	_, err = topics.CreateTopic("orders", log.Config{})
+	require.NoError(t, err)
+	offsets, err := log.NewOffsetStore(dir, log.Config{})
+	require.NoError(t, err)
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = topics
+		c.Offsets = offsets
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 1})
+	require.NoError(t, err)
+	// the group's offset is of the default log, so it can't be resumed from in the topic.
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: "orders", ResumeGroup: "billing"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerInmem(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		client api.LogClient,
+		config *Config,
+	){
+		"produce/consume a message to/from the log succeeds":                                    testProduceConsume,
+		"consume past boundary returns nil ConsumeResponse and error with expected status code": testConsumePastBoundary,
+		"consume stream returns records in stream":                                              testProduceConsumeStream,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, config, teardown := setupTest(t, func(c *Config) {
+				c.CommitLog = inmem.NewLog()
+			})
+			defer teardown()
+			fn(t, client, config)
+		})
+	}
+}
+
 func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
 	ctx := context.Background()
 	want := &api.Record{
@@ -58,6 +390,23 @@ func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
 	// so here, we are essentially checking that `segment.Append` assigns the correct value of offset to `want`.
 	require.Equal(t, want.Offset, consume.Record.Offset)
 }
+func testProduceConsumeDefaultTopic(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	want := &api.Record{Value: []byte("hello world")}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want, Topic: ""})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset, Topic: ""})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+
+	// the record is in the default log.
+	record, err := config.CommitLog.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, record.Value)
+}
+
 func testConsumePastBoundary(t *testing.T, client api.LogClient, config *Config) {
 	ctx := context.Background()
 	produce, err := client.Produce(ctx, &api.ProduceRequest{
@@ -77,6 +426,21 @@ func testConsumePastBoundary(t *testing.T, client api.LogClient, config *Config)
 	if got != want {
 		t.Fatalf("got err: %v, want: %v", got, want)
 	}
+
+	// the status details carry the log's range of offsets.
+	var info *errdetails.ErrorInfo
+	for _, d := range status.Convert(err).Details() {
+		if i, ok := d.(*errdetails.ErrorInfo); ok {
+			info = i
+		}
+	}
+	require.NotNil(t, info)
+	require.Equal(t, api.ReasonOffsetOutOfRange, info.Reason)
+	require.Equal(t, map[string]string{
+		api.MetadataOffset:  fmt.Sprint(produce.Offset + 1),
+		api.MetadataLowest:  "0",
+		api.MetadataHighest: fmt.Sprint(produce.Offset),
+	}, info.Metadata)
 }
 
 func testProduceConsumeStream(t *testing.T, client api.LogClient, config *Config) {
@@ -108,74 +472,1328 @@ func testProduceConsumeStream(t *testing.T, client api.LogClient, config *Config
 		for i, r := range records {
 			resp, err := stream.Recv()
 			require.NoError(t, err)
-			// Equal compares values, not memory address
-			require.Equal(t, resp.Record, &api.Record{
-				Value:  r.Value,
-				Offset: uint64(i),
-			})
+			// the record is compared field by field, as the log also stamps it with when it was appended.
+			require.Equal(t, r.Value, resp.Record.Value)
+			require.Equal(t, uint64(i), resp.Record.Offset)
 		}
 	}
 }
 
-func setupTest(t *testing.T, fn func(*Config)) (
-	client api.LogClient,
-	cfg *Config,
-	teardown func(),
-) {
-	t.Helper()
+func testGetVersion(t *testing.T, client api.LogClient, config *Config) {
+	defer func(v, c, b string) {
+		version.Version, version.Commit, version.BuildTime = v, c, b
+	}(version.Version, version.Commit, version.BuildTime)
+	// equivalent to injecting the values with -ldflags "-X ..."
+	version.Version = "v1.2.3"
+	version.Commit = "abc123"
+	version.BuildTime = "2021-01-01T00:00:00Z"
 
-	// automatically assign a free port
-	listener, err := net.Listen("tcp", "127.0.0.1:")
+	resp, err := client.GetVersion(context.Background(), &api.GetVersionRequest{})
 	require.NoError(t, err)
+	require.Equal(t, "v1.2.3", resp.Version)
+	require.Equal(t, "abc123", resp.Commit)
+	require.Equal(t, "2021-01-01T00:00:00Z", resp.BuildTime)
+	require.Equal(t, uint32(log.FormatVersion), resp.LogFormatVersion)
+}
 
-	// set up TLS
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
-		CAFile:        config.CAFile,
-		ServerAddress: listener.Addr().String(),
-		IsServer:      true,
+func testProduceConditional(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	record := &api.Record{Value: []byte("hello world")}
+
+	produce, err := client.ProduceConditional(ctx, &api.ProduceConditionalRequest{
+		Record:         record,
+		ExpectedOffset: 0,
 	})
 	require.NoError(t, err)
-	serverCreds := credentials.NewTLS(serverTLSConfig)
+	require.Equal(t, uint64(0), produce.Offset)
 
-	// commit log dependency
-	dir, err := ioutil.TempDir("", "server-test")
+	// a writer that still expects offset 0 conflicts with the first append.
+	produce, err = client.ProduceConditional(ctx, &api.ProduceConditionalRequest{
+		Record:         record,
+		ExpectedOffset: 0,
+	})
+	require.Nil(t, produce)
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	// like Produce, the request's codec is checked and recorded on the record.
+	_, err = client.ProduceConditional(ctx, &api.ProduceConditionalRequest{
+		Record:         &api.Record{Value: []byte("hello world")},
+		ExpectedOffset: 1,
+		Codec:          api.Codec(42),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	produce, err = client.ProduceConditional(ctx, &api.ProduceConditionalRequest{
+		Record:         &api.Record{Value: []byte("compressed")},
+		ExpectedOffset: 1,
+		Codec:          api.Codec_CODEC_GZIP,
+	})
 	require.NoError(t, err)
-	clog, err := log.NewLog(dir, log.Config{})
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
 	require.NoError(t, err)
-	cfg = &Config{
-		CommitLog: clog,
+	require.Equal(t, api.Codec_CODEC_GZIP, consume.Codec)
+}
+
+func testConsumeWaitFor(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	want := &api.Record{Value: []byte("hello world")}
+
+	// without waiting, the future offset is out of range.
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	produced := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: want})
+		produced <- err
+	}()
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:  0,
+		WaitFor: durationpb.New(5 * time.Second),
+	})
+	require.NoError(t, <-produced)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+
+	// the wait is bounded.
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:  1,
+		WaitFor: durationpb.New(50 * time.Millisecond),
+	})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testConsumeStreamFromLast(t *testing.T, client api.LogClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 50; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
 	}
-	if fn != nil {
-		fn(cfg)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{FromLast: 10})
+	require.NoError(t, err)
+	for off := uint64(40); off < 50; off++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, off, resp.Record.Offset)
 	}
-	server, err := NewGRPCServer(cfg, grpc.Creds(serverCreds))
+
+	// new records are streamed after the last ones.
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("record 50")},
+	})
 	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), resp.Record.Offset)
+	require.Equal(t, []byte("record 50"), resp.Record.Value)
+}
 
-	go func() {
-		server.Serve(listener)
-	}()
+func testConsumeBatch(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
 
-	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		// as the client, you only need access to the CA to verify the server's certificate
-		CAFile: config.CAFile,
-		// cert and key file are added to the CA that the server and authenticate the client
-		CertFile: config.ClientCertFile,
-		KeyFile:  config.ClientKeyFile,
-		IsServer: false, // specify this for clarity
+	for _, tc := range []struct {
+		offset     uint64
+		maxRecords uint32
+		want       []uint64
+	}{
+		{offset: 0, maxRecords: 2, want: []uint64{0, 1}},
+		{offset: 0, maxRecords: 3, want: []uint64{0, 1, 2}},
+		// partial batches stop at the tail without erroring.
+		{offset: 1, maxRecords: 5, want: []uint64{1, 2}},
+		{offset: 2, maxRecords: 5, want: []uint64{2}},
+	} {
+		resp, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{
+			Offset:     tc.offset,
+			MaxRecords: tc.maxRecords,
+		})
+		require.NoError(t, err)
+		var got []uint64
+		for _, r := range resp.Records {
+			require.Equal(t, []byte(fmt.Sprintf("record %d", r.Offset)), r.Value)
+			got = append(got, r.Offset)
+		}
+		require.Equal(t, tc.want, got)
+	}
+
+	_, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 3, MaxRecords: 5})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	_, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 0})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerConsumeBatchMaxRecords(t *testing.T) {
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxConsumeBatchRecords = 2
 	})
+	defer teardown()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	// the batch is clamped to the server's limit, however many records are asked for.
+	resp, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 0, MaxRecords: math.MaxUint32})
 	require.NoError(t, err)
-	clientCreds := credentials.NewTLS(clientTLSConfig)
-	// cc is a client connection to the server's address
-	cc, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(clientCreds))
+	require.Len(t, resp.Records, 2)
+	require.Equal(t, uint64(1), resp.Records[1].Offset)
+}
+
+func testProducePosition(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	first, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
 	require.NoError(t, err)
-	client = api.NewLogClient(cc)
+	require.Equal(t, uint64(0), first.Position)
+	require.Equal(t, uint64(0), first.BaseOffset)
 
-	return client, cfg, func() {
-		server.Stop()
-		cc.Close()
-		listener.Close()
-		clog.Remove()
+	second, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello again")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), second.BaseOffset)
+
+	// the second record is stored right after the first, which is its length followed by its data.
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: first.Offset})
+	require.NoError(t, err)
+	want := uint64(8 + proto.Size(consume.Record))
+	require.Equal(t, want, second.Position-first.Position)
+}
+
+func testGetOffsetRange(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	// an empty log has no records to consume, but the range is still reported.
+	got, err := client.GetOffsetRange(ctx, &emptypb.Empty{})
+	require.NoError(t, err)
+	require.True(t, got.Empty)
+	require.Equal(t, uint64(0), got.Lowest)
+	require.Equal(t, uint64(0), got.Highest)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+	got, err = client.GetOffsetRange(ctx, &emptypb.Empty{})
+	require.NoError(t, err)
+	require.False(t, got.Empty)
+	require.Equal(t, uint64(0), got.Lowest)
+	require.Equal(t, uint64(2), got.Highest)
+}
+
+func testGetLatest(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.GetLatest(ctx, &emptypb.Empty{})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+	got, err := client.GetLatest(ctx, &emptypb.Empty{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), got.Record.Offset)
+	require.Equal(t, []byte("record 2"), got.Record.Value)
+}
+
+func testProduceConsumeHeaders(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	headers := map[string]string{
+		"content-type": "application/json",
+		"source":       "test",
 	}
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte(`{"hello":"world"}`), Headers: headers},
+	})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, headers, consume.Record.Headers)
+}
+
+func testProduceCodec(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: compressed.Bytes()},
+		Codec:  api.Codec_CODEC_GZIP,
+	})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_GZIP, consume.Codec)
+	require.Equal(t, compressed.Bytes(), consume.Record.Value)
+	r, err := gzip.NewReader(bytes.NewReader(consume.Record.Value))
+	require.NoError(t, err)
+	value, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), value)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Codec:  api.Codec(42),
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testConsumeStreamEndOffset(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	for _, tc := range []struct {
+		offset, endOffset uint64
+		want              []uint64
+	}{
+		{offset: 1, endOffset: 3, want: []uint64{1, 2, 3}},
+		// the stream ends after the highest offset, rather than waiting for the end offset.
+		{offset: 2, endOffset: 10, want: []uint64{2, 3, 4}},
+	} {
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+			Offset:    tc.offset,
+			EndOffset: tc.endOffset,
+		})
+		require.NoError(t, err)
+		var got []uint64
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			got = append(got, resp.Record.Offset)
+		}
+		require.Equal(t, tc.want, got)
+	}
+}
+
+// denyAuthorizer denies action to subject, and permits everything else.
+type denyAuthorizer struct {
+	subject, action string
+	mu              sync.Mutex
+	calls           []string
+}
+
+func (a *denyAuthorizer) Authorize(subject, object, action string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, subject+" "+action)
+	if subject == a.subject && action == a.action {
+		return fmt.Errorf("%s not permitted to %s to %s", subject, action, object)
+	}
+	return nil
+}
+
+func TestServerAuthorization(t *testing.T) {
+	authorizer := &denyAuthorizer{subject: "client", action: produceAction}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Nil(t, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the client may still consume.
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	// the subject is the common name of the client's certificate.
+	require.Equal(t, []string{"client produce", "client produce", "client consume"}, authorizer.Calls())
+}
+
+// Calls returns the subject and action of every call to Authorize so far.
+func (a *denyAuthorizer) Calls() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.calls...)
+}
+
+func TestServerConsumeStreamAuthorizesOnce(t *testing.T) {
+	authorizer := &denyAuthorizer{}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0, EndOffset: 2})
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, resp.Record.Offset)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// the stream is authorized when it opens, rather than for every record it sends.
+	require.Equal(t, []string{"client produce", "client produce", "client produce", "client consume"}, authorizer.Calls())
+}
+
+func TestServerProduceStreamAuthorizesOnce(t *testing.T) {
+	for scenario, batchSize := range map[string]int{
+		"unbatched": 0,
+		"batched":   10,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			authorizer := &denyAuthorizer{}
+			client, _, teardown := setupTest(t, func(c *Config) {
+				c.Authorizer = authorizer
+				c.ProduceStreamBatchSize = batchSize
+				c.DedupCacheSize = 10
+			})
+			defer teardown()
+
+			stream, err := client.ProduceStream(context.Background())
+			require.NoError(t, err)
+			// records with dedup keys are produced on their own, rather than in a batch.
+			for i := 0; i < 3; i++ {
+				require.NoError(t, stream.Send(&api.ProduceRequest{
+					Record:   &api.Record{Value: []byte("hello world")},
+					DedupKey: fmt.Sprintf("key %d", i),
+				}))
+			}
+			for i := uint64(0); i < 3; i++ {
+				resp, err := stream.Recv()
+				require.NoError(t, err)
+				require.Equal(t, i, resp.Offset)
+			}
+
+			// the stream is authorized when it opens, rather than for every record it receives.
+			require.Equal(t, []string{"client produce"}, authorizer.Calls())
+		})
+	}
+}
+
+func TestServerCaughtUpConsumeStreamAuthorizesOnce(t *testing.T) {
+	authorizer := &denyAuthorizer{}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Authorizer = authorizer
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), resp.Record.Offset)
+
+	// the stream waits for the next record, without authorizing again while it waits or once the record is appended.
+	time.Sleep(100 * time.Millisecond)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), resp.Record.Offset)
+	require.Equal(t, []string{"client produce", "client consume", "client produce"}, authorizer.Calls())
+}
+
+// subjectLog records the subject of the last RPC that read from it.
+type subjectLog struct {
+	CommitLog
+	mu       sync.Mutex
+	cn, addr string
+	ok       bool
+}
+
+func (l *subjectLog) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	l.mu.Lock()
+	l.cn, l.addr, l.ok = SubjectFromContext(ctx)
+	l.mu.Unlock()
+	return l.CommitLog.Read(off)
+}
+
+func TestSubjectFromContext(t *testing.T) {
+	clog := &subjectLog{}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		clog.CommitLog = c.CommitLog
+		c.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	clog.mu.Lock()
+	defer clog.mu.Unlock()
+	require.True(t, clog.ok)
+	require.Equal(t, "client", clog.cn)
+	host, _, err := net.SplitHostPort(clog.addr)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", host)
+
+	// a context without a peer has no subject.
+	cn, addr, ok := SubjectFromContext(context.Background())
+	require.False(t, ok)
+	require.Equal(t, "", cn)
+	require.Equal(t, "", addr)
+}
+
+func TestServerHealth(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		detachCommitLog bool
+		want            healthpb.HealthCheckResponse_ServingStatus
+	}{
+		"serving with a commit log":        {want: healthpb.HealthCheckResponse_SERVING},
+		"not serving without a commit log": {detachCommitLog: true, want: healthpb.HealthCheckResponse_NOT_SERVING},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			cc, _, _, teardown := setupTestConn(t, func(c *Config) {
+				if tc.detachCommitLog {
+					c.CommitLog = nil
+				}
+			})
+			defer teardown()
+
+			got, err := CheckHealth(context.Background(), cc)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+// readNotifyingLog closes reading when the commit log is first read from.
+type readNotifyingLog struct {
+	CommitLog
+	reading  chan struct{}
+	readOnce sync.Once
+}
+
+func (l *readNotifyingLog) Read(off uint64) (*api.Record, error) {
+	l.readOnce.Do(func() { close(l.reading) })
+	return l.CommitLog.Read(off)
+}
+
+func TestServerGracefulStopEndsConsumeStreams(t *testing.T) {
+	clog := &readNotifyingLog{reading: make(chan struct{})}
+	cc, server, _, teardown := setupTestConn(t, func(c *Config) {
+		clog.CommitLog = c.CommitLog
+		c.CommitLog = clog
+	})
+	defer teardown()
+
+	stream, err := api.NewLogClient(cc).ConsumeStream(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	recvErr := make(chan error)
+	go func() {
+		_, err := stream.Recv()
+		recvErr <- err
+	}()
+	// the stream is waiting for a record to be appended.
+	<-clog.reading
+
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("graceful stop did not return")
+	}
+	require.Equal(t, io.EOF, <-recvErr)
+}
+
+// countingLog counts the reads from the log.
+type countingLog struct {
+	*log.Log
+	reads int64
+}
+
+func (l *countingLog) Read(off uint64) (*api.Record, error) {
+	atomic.AddInt64(&l.reads, 1)
+	return l.Log.Read(off)
+}
+
+func (l *countingLog) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	atomic.AddInt64(&l.reads, 1)
+	return l.Log.ReadContext(ctx, off)
+}
+
+func TestServerConsumeStreamJumpsOverCompactedOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-compacted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	const records = 50
+	for i := 0; i < records; i++ {
+		_, err := clog.Append(&api.Record{Key: []byte("key"), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// only the latest record of the key is left.
+	require.NoError(t, clog.Compact())
+
+	counting := &countingLog{Log: clog}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = counting
+	})
+	defer teardown()
+
+	stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{Offset: 0, EndOffset: records - 1})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(records-1), resp.Record.Offset)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+	// the stream jumps over the compacted offsets, rather than reading each of them.
+	require.Less(t, atomic.LoadInt64(&counting.reads), int64(5))
+}
+
+func TestServerConsumeBatchSkipsCompactedOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-compacted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	// the records of key x but the latest are compacted away, leaving gaps before and between the others.
+	for _, key := range []string{"x", "x", "a", "x", "x", "b", "x", "c", "d"} {
+		_, err := clog.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Compact())
+	_, err = clog.Read(0)
+	require.Error(t, err)
+
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		offset     uint64
+		maxRecords uint32
+		want       []uint64
+	}{
+		// a compacted first offset starts the batch from the next record.
+		{offset: 0, maxRecords: 2, want: []uint64{2, 5}},
+		{offset: 3, maxRecords: 10, want: []uint64{5, 6, 7, 8}},
+	} {
+		resp, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: tc.offset, MaxRecords: tc.maxRecords})
+		require.NoError(t, err)
+		var got []uint64
+		for _, r := range resp.Records {
+			got = append(got, r.Offset)
+		}
+		require.Equal(t, tc.want, got, tc.offset)
+	}
+	_, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 9, MaxRecords: 5})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+// batchCountingLog records the size of each batch appended to the log.
+type batchCountingLog struct {
+	*log.Log
+	mu      sync.Mutex
+	batches []int
+}
+
+func (l *batchCountingLog) AppendBatchWithMeta(records []*api.Record) ([]log.AppendInfo, error) {
+	l.mu.Lock()
+	l.batches = append(l.batches, len(records))
+	l.mu.Unlock()
+	return l.Log.AppendBatchWithMeta(records)
+}
+
+func TestServerProduceStreamBatches(t *testing.T) {
+	clog := &batchCountingLog{}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		clog.Log = c.CommitLog.(*log.Log)
+		c.CommitLog = clog
+		c.ProduceStreamBatchSize = 10
+		// long enough that only the last, partial batch is appended before it fills up.
+		c.ProduceStreamFlushInterval = time.Minute
+	})
+	defer teardown()
+
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+	const records = 105
+	go func() {
+		for i := 0; i < records; i++ {
+			err := stream.Send(&api.ProduceRequest{
+				Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+			})
+			if err != nil {
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+
+	var responses []*api.ProduceResponse
+	for i := uint64(0); i < records; i++ {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, resp.Offset)
+		responses = append(responses, resp)
+	}
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+
+	// like Produce, batched produces return where each record is stored:
+	// right after the previous record, which is its length followed by its data, or first in a new segment.
+	var segments int
+	for i, resp := range responses {
+		if i == 0 || resp.BaseOffset != responses[i-1].BaseOffset {
+			segments++
+			require.Equal(t, resp.Offset, resp.BaseOffset)
+			require.Equal(t, uint64(0), resp.Position)
+			continue
+		}
+		prev, err := clog.Read(responses[i-1].Offset)
+		require.NoError(t, err)
+		require.Equal(t, uint64(8+proto.Size(prev)), resp.Position-responses[i-1].Position)
+	}
+	require.Greater(t, segments, 1)
+
+	clog.mu.Lock()
+	defer clog.mu.Unlock()
+	require.Equal(t, []int{10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 5}, clog.batches)
+	record, err := clog.Read(records - 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte(fmt.Sprintf("record %d", records-1)), record.Value)
+}
+
+func TestServerConsumeStreamWaitsForAppends(t *testing.T) {
+	clog := &countingLog{}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		clog.Log = c.CommitLog.(*log.Log)
+		c.CommitLog = clog
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	// a caught-up stream blocks instead of reading the tail over and over.
+	time.Sleep(200 * time.Millisecond)
+	require.LessOrEqual(t, atomic.LoadInt64(&clog.reads), int64(2))
+
+	want := &api.Record{Value: []byte("hello world")}
+	_, err = client.Produce(context.Background(), &api.ProduceRequest{Record: want})
+	require.NoError(t, err)
+
+	type recv struct {
+		resp *api.ConsumeResponse
+		err  error
+	}
+	received := make(chan recv, 1)
+	go func() {
+		resp, err := stream.Recv()
+		received <- recv{resp, err}
+	}()
+	select {
+	case got := <-received:
+		require.NoError(t, got.err)
+		require.Equal(t, want.Value, got.resp.Record.Value)
+	case <-time.After(time.Second):
+		t.Fatal("record was not received")
+	}
+}
+
+// fakeMetrics counts the records produced and consumed, and the errors returned.
+type fakeMetrics struct {
+	mu       sync.Mutex
+	produced int
+	consumed int
+	errors   map[codes.Code]int
+}
+
+func (m *fakeMetrics) AddRecordsProduced(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.produced += n
+}
+
+func (m *fakeMetrics) AddRecordsConsumed(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consumed += n
+}
+
+func (m *fakeMetrics) IncErrors(method string, code codes.Code) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[code]++
+}
+
+func (m *fakeMetrics) ObserveAppendLatency(time.Duration) {}
+func (m *fakeMetrics) ObserveReadLatency(time.Duration)   {}
+
+func TestServerMetrics(t *testing.T) {
+	metrics := &fakeMetrics{errors: make(map[codes.Code]int)}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Metrics = metrics
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Error(t, err)
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	require.Equal(t, 1, metrics.produced)
+	require.Equal(t, 1, metrics.consumed)
+	require.Equal(t, 1, metrics.errors[status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())])
+}
+
+// capturingLogger keeps the RPCs it's asked to log.
+type capturingLogger struct {
+	mu   sync.Mutex
+	logs []RPCLog
+}
+
+func (l *capturingLogger) LogRPC(entry RPCLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, entry)
+}
+
+func TestServerLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Logger = logger
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	ctx = metadata.AppendToOutgoingContext(ctx, TraceIDKey, "trace-id")
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Error(t, err)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.logs, 2)
+
+	produce := logger.logs[0]
+	require.Equal(t, "Produce", produce.Method)
+	require.True(t, produce.Duration > 0)
+	require.Equal(t, codes.OK, produce.Code)
+	require.Equal(t, "client", produce.Subject)
+	require.NotEmpty(t, produce.TraceID)
+
+	consume := logger.logs[1]
+	require.Equal(t, "Consume", consume.Method)
+	require.Equal(t, uint64(1), consume.Offset)
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), consume.Code)
+	require.Equal(t, "trace-id", consume.TraceID)
+}
+
+func TestServerDedup(t *testing.T) {
+	client, cfg, teardown := setupTest(t, func(c *Config) {
+		c.DedupCacheSize = 1
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	produce := func(key string) uint64 {
+		t.Helper()
+		resp, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:   &api.Record{Value: []byte("hello world")},
+			DedupKey: key,
+		})
+		require.NoError(t, err)
+		return resp.Offset
+	}
+
+	first := produce("a")
+	require.Equal(t, first, produce("a"))
+	highest, err := cfg.CommitLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, first, highest)
+
+	// b evicts a, so a is appended again.
+	second := produce("b")
+	require.NotEqual(t, first, second)
+	third := produce("a")
+	require.NotEqual(t, first, third)
+	require.NotEqual(t, second, third)
+}
+
+func TestDedupCacheConcurrently(t *testing.T) {
+	c := newDedupCache(2)
+
+	// a produce with key a is blocked until unblock is closed.
+	unblock := make(chan struct{})
+	var calls int32
+	produceA := func() (*api.ProduceResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		<-unblock
+		return &api.ProduceResponse{Offset: 1}, nil
+	}
+	first := make(chan *api.ProduceResponse, 1)
+	go func() {
+		resp, _ := c.do("a", produceA)
+		first <- resp
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a produce with another key doesn't wait for it.
+	resp, err := c.do("b", func() (*api.ProduceResponse, error) {
+		return &api.ProduceResponse{Offset: 2}, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), resp.Offset)
+
+	// a retry with key a waits for the first produce and returns its response, without producing again.
+	retry := make(chan *api.ProduceResponse, 1)
+	go func() {
+		resp, _ := c.do("a", produceA)
+		retry <- resp
+	}()
+	close(unblock)
+	require.Equal(t, uint64(1), (<-first).Offset)
+	require.Equal(t, uint64(1), (<-retry).Offset)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestServerCommitOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	withOffsets := func(c *Config) {
+		offsets, err := log.NewOffsetStore(dir, log.Config{})
+		require.NoError(t, err)
+		c.Offsets = offsets
+	}
+	ctx := context.Background()
+
+	client, _, teardown := setupTest(t, withOffsets)
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "group", Offset: 2})
+	require.NoError(t, err)
+	teardown()
+
+	// the committed offset survives restarting the server.
+	client, cfg, teardown := setupTest(t, withOffsets)
+	defer teardown()
+	resp, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "group"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), resp.Offset)
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "other"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for i := 0; i < 3; i++ {
+		_, err := cfg.CommitLog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{ResumeGroup: "group"})
+	require.NoError(t, err)
+	consumed, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), consumed.Record.Offset)
+}
+
+func TestServerReplicate(t *testing.T) {
+	leaderCC, leader, leaderCfg, leaderTeardown := setupTestConn(t, nil)
+	defer leaderTeardown()
+	followerCC, _, followerCfg, followerTeardown := setupTestConn(t, nil)
+	defer followerTeardown()
+
+	produce := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			_, err := leaderCfg.CommitLog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+	}
+	// converged waits for the follower to have the leader's records, with the same offsets.
+	converged := func(highest uint64) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			off, err := followerCfg.CommitLog.HighestOffset()
+			return err == nil && off == highest
+		}, 5*time.Second, 10*time.Millisecond)
+		follower := api.NewLogClient(followerCC)
+		for off := uint64(0); off <= highest; off++ {
+			want, err := leaderCfg.CommitLog.Read(off)
+			require.NoError(t, err)
+			got, err := follower.Consume(context.Background(), &api.ConsumeRequest{Offset: off})
+			require.NoError(t, err)
+			require.Equal(t, want.Value, got.Record.Value)
+			require.Equal(t, off, got.Record.Offset)
+		}
+	}
+
+	produce(3)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Replicate(
+			ctx,
+			leaderCC.Target(),
+			followerCfg.CommitLog.(*log.Log),
+			grpc.WithTransportCredentials(newClientCreds(t)),
+		)
+	}()
+	converged(2)
+
+	// the follower picks up where it left off once the leader is back.
+	addr := leaderCC.Target()
+	leader.Stop()
+	produce(2)
+	listener, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	restarted, err := NewGRPCServer(leaderCfg, grpc.Creds(newServerCreds(t, addr)))
+	require.NoError(t, err)
+	go restarted.Serve(listener)
+	defer restarted.Stop()
+	converged(4)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestServerReplicateCompactedLeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-replicate-compacted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	leaderLog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer leaderLog.Close()
+	// every other record overwrites the same key, starting with offset 0,
+	// so the compacted leader has gaps, including before its first record.
+	const records = 10
+	for i := 0; i < records; i++ {
+		key := fmt.Sprintf("key %d", i)
+		if i%2 == 0 {
+			key = "overwritten"
+		}
+		_, err := leaderLog.Append(&api.Record{Key: []byte(key), Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, leaderLog.Compact())
+	_, err = leaderLog.Read(0)
+	require.Error(t, err)
+
+	leaderCC, _, _, leaderTeardown := setupTestConn(t, func(c *Config) {
+		c.CommitLog = leaderLog
+	})
+	defer leaderTeardown()
+	_, _, followerCfg, followerTeardown := setupTestConn(t, nil)
+	defer followerTeardown()
+	follower := followerCfg.CommitLog.(*log.Log)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Replicate(ctx, leaderCC.Target(), follower, grpc.WithTransportCredentials(newClientCreds(t)))
+	}()
+	require.Eventually(t, func() bool {
+		off, err := follower.HighestOffset()
+		return err == nil && off == records-1
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	// the follower has the leader's records at the same offsets, and no records where the leader has none.
+	for off := uint64(0); off < records; off++ {
+		want, wantErr := leaderLog.Read(off)
+		got, err := follower.Read(off)
+		if wantErr != nil {
+			require.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+}
+
+func TestServerMaxRecordBytes(t *testing.T) {
+	const maxRecordBytes = 1 << 10
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.MaxRecordBytes = maxRecordBytes
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, maxRecordBytes)},
+	})
+	require.NoError(t, err)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, maxRecordBytes+1)},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, maxRecordBytes+1)},
+	}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServerConsumeStreamHeartbeat(t *testing.T) {
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.ConsumeStreamHeartbeatInterval = 20 * time.Millisecond
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.False(t, resp.Heartbeat)
+	require.Equal(t, produce.Offset, resp.Record.Offset)
+
+	// the stream has caught up, so it is idle until the heartbeat.
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.True(t, resp.Heartbeat)
+	require.Nil(t, resp.Record)
+
+	// records produced after a heartbeat are still streamed.
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello again")},
+	})
+	require.NoError(t, err)
+	for {
+		resp, err = stream.Recv()
+		require.NoError(t, err)
+		if !resp.Heartbeat {
+			break
+		}
+	}
+	require.Equal(t, produce.Offset, resp.Record.Offset)
+}
+
+func TestServerServeMux(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	server, err := NewGRPCServer(&Config{CommitLog: clog}, grpc.Creds(newServerCreds(t, addr)))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	served := make(chan error)
+	go func() {
+		served <- server.ServeMux(listener, mux)
+	}()
+
+	resp, err := http.Get("http://" + addr + "/healthz")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "ok", string(body))
+
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(newClientCreds(t)))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	produce, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(context.Background(), &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+	// stopping the server closes the shared listener.
+	server.Stop()
+	require.NoError(t, <-served)
+}
+
+func TestServerServeMuxFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	// a stopped gRPC server can't serve, so the HTTP server isn't left serving on its own.
+	server, err := NewGRPCServer(&Config{CommitLog: clog})
+	require.NoError(t, err)
+	server.Stop()
+	served := make(chan error)
+	go func() {
+		served <- server.ServeMux(listener, http.NewServeMux())
+	}()
+	select {
+	case err := <-served:
+		require.Equal(t, grpc.ErrServerStopped, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeMux kept serving HTTP after the gRPC server failed")
+	}
+}
+
+func setupTest(t *testing.T, fn func(*Config)) (
+	client api.LogClient,
+	cfg *Config,
+	teardown func(),
+) {
+	t.Helper()
+	cc, _, cfg, teardown := setupTestConn(t, fn)
+	return api.NewLogClient(cc), cfg, teardown
+}
+
+// setupTestConn starts a server and returns a client connection to it.
+func setupTestConn(t *testing.T, fn func(*Config)) (
+	cc *grpc.ClientConn,
+	server *Server,
+	cfg *Config,
+	teardown func(),
+) {
+	t.Helper()
+	// automatically assign a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+
+	serverCreds := newServerCreds(t, listener.Addr().String())
+
+	// commit log dependency
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	cfg = &Config{
+		CommitLog: clog,
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	server, err = NewGRPCServer(cfg, grpc.Creds(serverCreds))
+	require.NoError(t, err)
+
+	go func() {
+		server.Serve(listener)
+	}()
+
+	// cc is a client connection to the server's address
+	cc, err = grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(newClientCreds(t)))
+	require.NoError(t, err)
+
+	return cc, server, cfg, func() {
+		server.Stop()
+		cc.Close()
+		listener.Close()
+		clog.Remove()
+	}
+}
+
+// newServerCreds returns the credentials of a server listening on addr.
+func newServerCreds(t *testing.T, addr string) credentials.TransportCredentials {
+	t.Helper()
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: addr,
+		IsServer:      true,
+	})
+	require.NoError(t, err)
+	return credentials.NewTLS(serverTLSConfig)
+}
+
+// newClientCreds returns the credentials of the client that connects to the test servers.
+func newClientCreds(t *testing.T) credentials.TransportCredentials {
+	t.Helper()
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		// as the client, you only need access to the CA to verify the server's certificate
+		CAFile: config.CAFile,
+		// cert and key file are added to the CA that the server and authenticate the client
+		CertFile: config.ClientCertFile,
+		KeyFile:  config.ClientKeyFile,
+		IsServer: false, // specify this for clarity
+	})
+	require.NoError(t, err)
+	return credentials.NewTLS(clientTLSConfig)
 }
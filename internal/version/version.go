@@ -0,0 +1,14 @@
+// Package version holds the build information of the binary.
+// The values are injected at build time via ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/jxofficial/proglog/internal/version.Version=v1.0.0"
+package version
+
+var (
+	// Version is the release version of the build.
+	Version = "dev"
+	// Commit is the git commit the build was made from.
+	Commit = "unknown"
+	// BuildTime is the time the build was made.
+	BuildTime = "unknown"
+)